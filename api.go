@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/hlog"
+)
+
+// propertySetter sets a single property of a device from its JSON value.
+type propertySetter func(ctx context.Context, client starling.Client, id string, value json.RawMessage) error
+
+// propertySetters are the properties which can be set through the API.
+var propertySetters = map[string]propertySetter{
+	"targetTemperature":                 floatSetter(starling.Client.SetTargetTemperature),
+	"targetHeatingThresholdTemperature": floatSetter(starling.Client.SetHeatingThreshold),
+	"targetCoolingThresholdTemperature": floatSetter(starling.Client.SetCoolingThreshold),
+	"targetHumidity":                    floatSetter(starling.Client.SetTargetHumidity),
+	"ecoMode": func(ctx context.Context, client starling.Client, id string, value json.RawMessage) error {
+		var v bool
+		if err := json.Unmarshal(value, &v); err != nil {
+			return errBadValue{err}
+		}
+		return client.SetEcoMode(ctx, id, v)
+	},
+	"hvacMode": func(ctx context.Context, client starling.Client, id string, value json.RawMessage) error {
+		var v starling.HVACMode
+		if err := json.Unmarshal(value, &v); err != nil {
+			return errBadValue{err}
+		}
+		return client.SetHVACMode(ctx, id, v)
+	},
+	// The fan timer duration is given in seconds; 0 stops the timer.
+	"fanTimerDuration": func(ctx context.Context, client starling.Client, id string, value json.RawMessage) error {
+		var v float64
+		if err := json.Unmarshal(value, &v); err != nil {
+			return errBadValue{err}
+		}
+		return client.SetFanTimer(ctx, id, time.Duration(v*float64(time.Second)))
+	},
+}
+
+// defaultWritableProperties are the properties which can be set through the
+// API unless configured otherwise.
+var defaultWritableProperties = []string{
+	"targetTemperature",
+	"targetHeatingThresholdTemperature",
+	"targetCoolingThresholdTemperature",
+	"hvacMode",
+	"ecoMode",
+}
+
+func floatSetter(set func(starling.Client, context.Context, string, float64) error) propertySetter {
+	return func(ctx context.Context, client starling.Client, id string, value json.RawMessage) error {
+		var v float64
+		if err := json.Unmarshal(value, &v); err != nil {
+			return errBadValue{err}
+		}
+		return set(client, ctx, id, v)
+	}
+}
+
+// errBadValue is returned by a propertySetter when the value can't be decoded.
+type errBadValue struct {
+	err error
+}
+
+func (e errBadValue) Error() string { return "invalid value: " + e.err.Error() }
+func (e errBadValue) Unwrap() error { return e.err }
+
+// apiServer serves the JSON API under /api/v1.
+type apiServer struct {
+	client  starling.Client
+	store   *deviceStore
+	changes *changeBroker
+	// token is the bearer token required to change devices. If it's empty,
+	// devices can't be changed.
+	token    string
+	writable map[string]bool
+}
+
+// newAPIServer returns an apiServer which serves devices from store and
+// streams changes from the broker. The writable properties can be set by
+// clients giving token.
+func newAPIServer(client starling.Client, store *deviceStore, changes *changeBroker, token string, writable []string) (*apiServer, error) {
+	s := &apiServer{
+		client:   client,
+		store:    store,
+		changes:  changes,
+		token:    token,
+		writable: make(map[string]bool, len(writable)),
+	}
+	for _, property := range writable {
+		if _, ok := propertySetters[property]; !ok {
+			return nil, fmt.Errorf("property %s can't be set", property)
+		}
+		s.writable[property] = true
+	}
+	return s, nil
+}
+
+// devices handles /api/v1/devices.
+func (s *apiServer) devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{"devices": s.store.list()})
+}
+
+// device handles /api/v1/devices/{id}.
+func (s *apiServer) device(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/devices/")
+	if id == "" || strings.Contains(id, "/") {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	allow := "GET, HEAD"
+	if s.token != "" {
+		allow += ", POST"
+	}
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.getDevice(w, id)
+	case r.Method == http.MethodPost && s.token != "":
+		s.setDevice(w, r, id)
+	default:
+		w.Header().Set("Allow", allow)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *apiServer) getDevice(w http.ResponseWriter, id string) {
+	snap, ok := s.store.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, snap)
+}
+
+func (s *apiServer) setDevice(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	// Every writable property is a thermostat's, so don't send them to any
+	// other device.
+	device, ok := s.store.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	if device.Type != "thermostat" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("device is a %s, not a thermostat", device.Type))
+		return
+	}
+
+	properties := map[string]json.RawMessage{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&properties); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(properties) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "no properties given")
+		return
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		if !s.writable[name] {
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("property %s is not writable", name))
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := propertySetters[name](r.Context(), s.client, id, properties[name])
+		var bad errBadValue
+		switch {
+		case err == nil:
+			hlog.FromRequest(r).Info().Str("id", id).Str("property", name).RawJSON("value", properties[name]).Msg("property set")
+			continue
+		case errors.As(err, &bad), errors.Is(err, starling.ErrInvalidValue), errors.Is(err, starling.ErrNotSupported):
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", name, err))
+		case errors.Is(err, starling.ErrWriteNotPermitted):
+			writeAPIError(w, http.StatusForbidden, err.Error())
+		default:
+			hlog.FromRequest(r).Err(err).Str("id", id).Str("property", name).Msg("error setting property")
+			writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("%s: %v", name, err))
+		}
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// events handles /api/v1/events, streaming device property changes as
+// Server-Sent Events until the client disconnects. The optional device query
+// parameter limits the stream to a single device.
+func (s *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	device := r.URL.Query().Get("device")
+
+	ch := s.changes.subscribe(64)
+	defer s.changes.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case change := <-ch:
+			if device != "" && change.ID != device {
+				continue
+			}
+			b, err := json.Marshal(change)
+			if err != nil {
+				hlog.FromRequest(r).Err(err).Msg("error encoding change")
+				continue
+			}
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+		}
+		flusher.Flush()
+	}
+}
+
+// authorized reports whether the request has the right bearer token.
+func (s *apiServer) authorized(r *http.Request) bool {
+	return bearerAuthorized(r, s.token)
+}
+
+// bearerAuthorized reports whether the request has token as its bearer token.
+// No request is authorized if token is empty.
+func bearerAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cameraLabels = []string{"id", "name", "where"}
+
+	cameraEventsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemCamera, "events_total"),
+		"Number of events detected by the camera",
+		append(cameraLabels, "event"),
+		nil,
+	)
+)
+
+// cameraEventNames are the values of the event label, in the order they are
+// exported.
+var cameraEventNames = []string{
+	"doorbell",
+	"motion",
+	"person",
+	"animal",
+	"vehicle",
+	"sound",
+	"package_delivered",
+	"package_retrieved",
+}
+
+func init() {
+	// Only the event counters are exported, which come from the background
+	// poller, so the camera's properties aren't needed.
+	registerDeviceType("cam", deviceFunc[starling.CameraProperties](func(c Collector, camera starling.CommonProperties, ch chan<- prometheus.Metric) {
+		if c.cameraEvents == nil {
+			return
+		}
+		cameraMetrics(camera, c.cameraEvents.get(camera.ID), ch)
+	}))
+}
+
+func cameraEventStates(camera starling.CameraProperties) map[string]bool {
+	return map[string]bool{
+		"doorbell":          camera.DoorbellPushed,
+		"motion":            camera.MotionDetected,
+		"person":            camera.PersonDetected,
+		"animal":            camera.AnimalDetected,
+		"vehicle":           camera.VehicleDetected,
+		"sound":             camera.SoundDetected,
+		"package_delivered": camera.PackageDelivered,
+		"package_retrieved": camera.PackageRetrieved,
+	}
+}
+
+// cameraEventCounter counts the rising edges of each camera's momentary event
+// properties, as seen by the background poller.
+type cameraEventCounter struct {
+	mu     sync.Mutex
+	last   map[string]map[string]bool
+	counts map[string]map[string]float64
+}
+
+func newCameraEventCounter() *cameraEventCounter {
+	return &cameraEventCounter{
+		last:   make(map[string]map[string]bool),
+		counts: make(map[string]map[string]float64),
+	}
+}
+
+// observe records the current event properties of the camera, incrementing
+// the counter of every event which has become active since the previous poll.
+// Events which are already active the first time a camera is seen are not
+// counted, as they may have started long before the exporter did.
+func (c *cameraEventCounter) observe(camera starling.CameraProperties) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states := cameraEventStates(camera)
+	last, seen := c.last[camera.ID]
+	counts, ok := c.counts[camera.ID]
+	if !ok {
+		counts = make(map[string]float64)
+		c.counts[camera.ID] = counts
+	}
+	if seen {
+		for event, active := range states {
+			if active && !last[event] {
+				counts[event]++
+			}
+		}
+	}
+	c.last[camera.ID] = states
+}
+
+// get returns a copy of the event counts for the camera.
+func (c *cameraEventCounter) get(id string) map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]float64, len(c.counts[id]))
+	for event, n := range c.counts[id] {
+		counts[event] = n
+	}
+	return counts
+}
+
+func cameraMetrics(camera starling.CommonProperties, counts map[string]float64, ch chan<- prometheus.Metric) {
+	for _, event := range cameraEventNames {
+		ch <- prometheus.MustNewConstMetric(
+			cameraEventsTotal,
+			prometheus.CounterValue,
+			counts[event],
+			camera.ID, camera.Name, camera.Where, event,
+		)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesog/nest_exporter/starling"
+)
+
+func TestCameraEventCounter(t *testing.T) {
+	camera := func(motion, person bool) starling.CameraProperties {
+		return starling.CameraProperties{
+			CommonProperties: starling.CommonProperties{ID: "c1"},
+			MotionDetected:   motion,
+			PersonDetected:   person,
+		}
+	}
+	tests := []struct {
+		name  string
+		polls []starling.CameraProperties
+		want  map[string]float64
+	}{
+		{
+			name:  "active on first sight",
+			polls: []starling.CameraProperties{camera(true, true)},
+			want:  map[string]float64{},
+		},
+		{
+			name:  "still active",
+			polls: []starling.CameraProperties{camera(true, false), camera(true, false), camera(true, false)},
+			want:  map[string]float64{},
+		},
+		{
+			name:  "rising edge",
+			polls: []starling.CameraProperties{camera(false, false), camera(true, false), camera(true, false)},
+			want:  map[string]float64{"motion": 1},
+		},
+		{
+			name:  "falling edge",
+			polls: []starling.CameraProperties{camera(true, true), camera(false, true)},
+			want:  map[string]float64{},
+		},
+		{
+			name: "repeated events",
+			polls: []starling.CameraProperties{
+				camera(false, false),
+				camera(true, true),
+				camera(false, true),
+				camera(true, false),
+			},
+			want: map[string]float64{"motion": 2, "person": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCameraEventCounter()
+			for _, camera := range tt.polls {
+				c.observe(camera)
+			}
+			got := c.get("c1")
+			for event, n := range got {
+				if n == 0 {
+					delete(got, event)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got counts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
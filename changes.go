@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// propertyChange is a change to a single property of a device between two
+// polls.
+type propertyChange struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	Where    string    `json:"where"`
+	Property string    `json:"property"`
+	Old      any       `json:"old"`
+	New      any       `json:"new"`
+	At       time.Time `json:"at"`
+}
+
+// propertiesMap converts a properties struct to a map of its JSON properties,
+// so that properties of any device type can be compared.
+func propertiesMap(properties any) (map[string]any, error) {
+	if m, ok := properties.(map[string]any); ok {
+		return m, nil
+	}
+	b, err := json.Marshal(properties)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// diffProperties returns a change for every property which differs between
+// old and new, ordered by property name.
+func diffProperties(device starling.CommonProperties, old, new any, at time.Time) ([]propertyChange, error) {
+	oldProps, err := propertiesMap(old)
+	if err != nil {
+		return nil, err
+	}
+	newProps, err := propertiesMap(new)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(newProps))
+	for name := range oldProps {
+		names[name] = true
+	}
+	for name := range newProps {
+		names[name] = true
+	}
+
+	var changes []propertyChange
+	for name := range names {
+		o, n := oldProps[name], newProps[name]
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		changes = append(changes, propertyChange{
+			ID:       device.ID,
+			Type:     device.Type,
+			Name:     device.Name,
+			Where:    device.Where,
+			Property: name,
+			Old:      o,
+			New:      n,
+			At:       at,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Property < changes[j].Property })
+	return changes, nil
+}
+
+var changesDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "changes",
+		Name:      "dropped_total",
+		Help:      "Number of device property changes dropped because a subscriber wasn't keeping up",
+	},
+)
+
+// changeSubscription is a subscriber to a changeBroker.
+type changeSubscription struct {
+	// reliable subscribers are never dropped changes; publishing waits for
+	// them instead.
+	reliable bool
+	// done is closed when the subscriber unsubscribes.
+	done chan struct{}
+}
+
+// changeBroker fans out property changes to subscribers.
+type changeBroker struct {
+	mu   sync.Mutex
+	subs map[chan propertyChange]changeSubscription
+}
+
+func newChangeBroker() *changeBroker {
+	return &changeBroker{subs: make(map[chan propertyChange]changeSubscription)}
+}
+
+// subscribe returns a channel which receives every change published after it
+// was subscribed. Changes are dropped if the channel's buffer is full, so a
+// slow subscriber can't hold up the poller.
+func (b *changeBroker) subscribe(buffer int) chan propertyChange {
+	return b.add(buffer, false)
+}
+
+// subscribeReliable is like subscribe, but changes are never dropped. If the
+// channel's buffer is full, the poller waits for the subscriber, so it must
+// not block for long.
+func (b *changeBroker) subscribeReliable(buffer int) chan propertyChange {
+	return b.add(buffer, true)
+}
+
+func (b *changeBroker) add(buffer int, reliable bool) chan propertyChange {
+	ch := make(chan propertyChange, buffer)
+	b.mu.Lock()
+	b.subs[ch] = changeSubscription{reliable: reliable, done: make(chan struct{})}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *changeBroker) unsubscribe(ch chan propertyChange) {
+	b.mu.Lock()
+	if sub, ok := b.subs[ch]; ok {
+		close(sub.done)
+		delete(b.subs, ch)
+	}
+	b.mu.Unlock()
+}
+
+func (b *changeBroker) publish(change propertyChange) {
+	// Reliable subscribers are waited for without holding the lock, so that
+	// they can unsubscribe meanwhile.
+	b.mu.Lock()
+	reliable := make(map[chan propertyChange]changeSubscription)
+	for ch, sub := range b.subs {
+		if sub.reliable {
+			reliable[ch] = sub
+			continue
+		}
+		select {
+		case ch <- change:
+		default:
+			changesDropped.Inc()
+			log.Warn().Str("id", change.ID).Str("property", change.Property).Msg("dropped change for slow subscriber")
+		}
+	}
+	b.mu.Unlock()
+
+	for ch, sub := range reliable {
+		select {
+		case ch <- change:
+		case <-sub.done:
+		}
+	}
+}
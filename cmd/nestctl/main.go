@@ -0,0 +1,226 @@
+// Command nestctl queries and controls devices through the Starling Home Hub
+// API.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jamesog/nest_exporter/starling"
+	flag "github.com/spf13/pflag"
+)
+
+const usage = `Usage: nestctl [flags] <command>
+
+Commands:
+  status                                   Show the status of the Starling API
+  devices list                             List all devices
+  device get <id> [property]               Show the properties of a device
+  device set <id> <property>=<value>...    Set properties of a device
+
+Flags:
+`
+
+var errUsage = errors.New("invalid usage")
+
+type outputFormat string
+
+const (
+	outputTable outputFormat = "table"
+	outputJSON  outputFormat = "json"
+)
+
+func main() {
+	starlingAPIFlag := flag.String("starling.api", "", "The base URL of the Starling API (overrides STARLING_API_URL)")
+	output := flag.StringP("output", "o", string(outputTable), "Output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	starlingAPI := os.Getenv("STARLING_API_URL")
+	if *starlingAPIFlag != "" {
+		starlingAPI = *starlingAPIFlag
+	}
+	if starlingAPI == "" {
+		fatalf("Starling API not set; must set either STARLING_API_URL or --starling.api")
+	}
+	starlingAPIKey := os.Getenv("STARLING_API_KEY")
+	if starlingAPIKey == "" {
+		fatalf("Starling API key not set; must set STARLING_API_KEY")
+	}
+
+	format := outputFormat(*output)
+	if format != outputTable && format != outputJSON {
+		fatalf("unknown output format %q", *output)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client := starling.NewClient(starlingAPI, starlingAPIKey)
+	err := run(ctx, client, format, os.Stdout, flag.Args())
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "nestctl: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+func run(ctx context.Context, client starling.Client, format outputFormat, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		return status(client, format, w)
+	case args[0] == "devices" && len(args) == 2 && args[1] == "list":
+		return listDevices(client, format, w)
+	case args[0] == "device" && len(args) >= 3 && args[1] == "get":
+		return getDevice(ctx, client, format, w, args[2], args[3:])
+	case args[0] == "device" && len(args) >= 4 && args[1] == "set":
+		return setDevice(ctx, client, args[2], args[3:])
+	default:
+		return errUsage
+	}
+}
+
+func status(client starling.Client, format outputFormat, w io.Writer) error {
+	s, err := client.Status()
+	if err != nil {
+		return err
+	}
+	if format == outputJSON {
+		return writeJSON(w, s)
+	}
+
+	return writeTable(w, []string{"FIELD", "VALUE"}, [][]string{
+		{"App name", s.AppName},
+		{"API version", fmt.Sprint(s.APIVersion)},
+		{"API ready", fmt.Sprint(s.APIReady)},
+		{"Connected to Nest", fmt.Sprint(s.ConnectedToNest)},
+		{"Read permission", fmt.Sprint(s.Permissions.Read)},
+		{"Write permission", fmt.Sprint(s.Permissions.Write)},
+		{"Camera permission", fmt.Sprint(s.Permissions.Camera)},
+	})
+}
+
+func listDevices(client starling.Client, format outputFormat, w io.Writer) error {
+	devices, err := client.Devices()
+	if err != nil {
+		return err
+	}
+	if format == outputJSON {
+		return writeJSON(w, devices.Devices)
+	}
+
+	rows := make([][]string, 0, len(devices.Devices))
+	for _, d := range devices.Devices {
+		rows = append(rows, []string{d.ID, d.Type, d.Name, d.Where, d.StructureName})
+	}
+	return writeTable(w, []string{"ID", "TYPE", "NAME", "WHERE", "STRUCTURE"}, rows)
+}
+
+func getDevice(ctx context.Context, client starling.Client, format outputFormat, w io.Writer, id string, args []string) error {
+	var properties map[string]any
+	switch len(args) {
+	case 0:
+		p, err := starling.DeviceProperties[map[string]any](ctx, client, id)
+		if err != nil {
+			return err
+		}
+		properties = *p
+	case 1:
+		v, err := starling.DeviceProperty[any](ctx, client, id, args[0])
+		if err != nil {
+			return err
+		}
+		properties = map[string]any{args[0]: v}
+	default:
+		return errUsage
+	}
+	if format == outputJSON {
+		return writeJSON(w, properties)
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, []string{name, formatValue(properties[name])})
+	}
+	return writeTable(w, []string{"PROPERTY", "VALUE"}, rows)
+}
+
+func setDevice(ctx context.Context, client starling.Client, id string, args []string) error {
+	properties := make(map[string]any, len(args))
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid property %q; must be <property>=<value>", arg)
+		}
+		properties[name] = parseValue(value)
+	}
+
+	return client.SetDeviceProperties(ctx, id, properties)
+}
+
+// parseValue interprets value as JSON, so that numbers and booleans are sent
+// with the right type, falling back to a plain string.
+func parseValue(value string) any {
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return value
+	}
+	return v
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceType fetches and collects the metrics for one type of Starling device.
+type deviceType interface {
+	// fetch returns the device's properties.
+	fetch(ctx context.Context, client starling.Client, id string) (any, error)
+	// collect sends the device's metrics from its latest snapshot, whose
+	// Properties were returned by fetch.
+	collect(c Collector, device deviceSnapshot, ch chan<- prometheus.Metric) error
+}
+
+// deviceTypes maps Starling's device type strings to the deviceType which
+// handles them. Device types register themselves from init functions.
+var deviceTypes = make(map[string]deviceType)
+
+func registerDeviceType(name string, t deviceType) {
+	if _, ok := deviceTypes[name]; ok {
+		panic("device type " + name + " registered twice")
+	}
+	deviceTypes[name] = t
+}
+
+// supportedDeviceTypes returns the names of the registered device types, in
+// order.
+func supportedDeviceTypes() []string {
+	names := make([]string, 0, len(deviceTypes))
+	for name := range deviceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// typedDevice is a deviceType whose properties are fetched from Starling and
+// decoded into P.
+type typedDevice[P any] func(c Collector, properties P, ch chan<- prometheus.Metric)
+
+// fetch returns the device's properties as a *P.
+func (t typedDevice[P]) fetch(ctx context.Context, client starling.Client, id string) (any, error) {
+	return starling.DeviceProperties[P](ctx, client, id)
+}
+
+func (t typedDevice[P]) collect(c Collector, device deviceSnapshot, ch chan<- prometheus.Metric) error {
+	properties, ok := device.Properties.(*P)
+	if !ok {
+		return fmt.Errorf("unexpected properties type %T", device.Properties)
+	}
+	t(c, *properties, ch)
+	return nil
+}
+
+// deviceFunc is a deviceType which collects using only what is returned by the
+// device list, ignoring the rest of the device's properties. The poller still
+// fetches them, decoded into P.
+type deviceFunc[P any] func(c Collector, device starling.CommonProperties, ch chan<- prometheus.Metric)
+
+// fetch returns the device's properties as a *P.
+func (f deviceFunc[P]) fetch(ctx context.Context, client starling.Client, id string) (any, error) {
+	return starling.DeviceProperties[P](ctx, client, id)
+}
+
+func (f deviceFunc[P]) collect(c Collector, device deviceSnapshot, ch chan<- prometheus.Metric) error {
+	f(c, device.CommonProperties, ch)
+	return nil
+}
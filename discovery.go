@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/log"
+)
+
+// haDevice is the device block of a Home Assistant discovery config, which
+// groups the entities of a Nest device together.
+type haDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Manufacturer  string   `json:"manufacturer"`
+	Model         string   `json:"model"`
+	SerialNumber  string   `json:"serial_number,omitempty"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+// haEntity is a Home Assistant discovery config. Only the fields used by the
+// entities we publish are included.
+type haEntity struct {
+	// component is the Home Assistant integration, such as climate or
+	// binary_sensor. It's part of the discovery topic, not the config.
+	component string
+	// key distinguishes the entities of a single device.
+	key string
+
+	Name              string   `json:"name,omitempty"`
+	UniqueID          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+
+	StateTopic        string `json:"state_topic,omitempty"`
+	PayloadOn         string `json:"payload_on,omitempty"`
+	PayloadOff        string `json:"payload_off,omitempty"`
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+
+	// Lock
+	CommandTopic  string `json:"command_topic,omitempty"`
+	PayloadLock   string `json:"payload_lock,omitempty"`
+	PayloadUnlock string `json:"payload_unlock,omitempty"`
+	StateLocked   string `json:"state_locked,omitempty"`
+	StateUnlocked string `json:"state_unlocked,omitempty"`
+
+	// Climate
+	CurrentTemperatureTopic string   `json:"current_temperature_topic,omitempty"`
+	CurrentHumidityTopic    string   `json:"current_humidity_topic,omitempty"`
+	TemperatureStateTopic   string   `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string   `json:"temperature_command_topic,omitempty"`
+	ModeStateTopic          string   `json:"mode_state_topic,omitempty"`
+	ModeStateTemplate       string   `json:"mode_state_template,omitempty"`
+	ModeCommandTopic        string   `json:"mode_command_topic,omitempty"`
+	ModeCommandTemplate     string   `json:"mode_command_template,omitempty"`
+	Modes                   []string `json:"modes,omitempty"`
+	TemperatureUnit         string   `json:"temperature_unit,omitempty"`
+	Precision               float64  `json:"precision,omitempty"`
+}
+
+// haModeStateTemplate and haModeCommandTemplate convert between Starling's
+// and Home Assistant's HVAC modes.
+const (
+	haModeStateTemplate   = `{{ {"heatCool": "heat_cool"}.get(value, value) }}`
+	haModeCommandTemplate = `{{ {"heat_cool": "heatCool"}.get(value, value) }}`
+)
+
+// binarySensor returns a binary_sensor entity for a boolean property.
+func binarySensor(key, name, deviceClass, stateTopic string) haEntity {
+	return haEntity{
+		component:   "binary_sensor",
+		key:         key,
+		Name:        name,
+		DeviceClass: deviceClass,
+		StateTopic:  stateTopic,
+		PayloadOn:   "true",
+		PayloadOff:  "false",
+	}
+}
+
+// homeAssistantEntities returns the Home Assistant entities for a device.
+// Device types without a Home Assistant equivalent have none. The entities'
+// state comes from the topics the device's properties are published to.
+func (m *mqttPublisher) homeAssistantEntities(device deviceSnapshot) []haEntity {
+	base := m.deviceTopic(device) + "/"
+
+	var entities []haEntity
+	switch device.Type {
+	case "thermostat":
+		properties, ok := device.Properties.(*starling.ThermostatProperties)
+		if !ok {
+			break
+		}
+		modes := []string{"off"}
+		if properties.CanHeat {
+			modes = append(modes, "heat")
+		}
+		if properties.CanCool {
+			modes = append(modes, "cool")
+		}
+		if properties.CanHeat && properties.CanCool {
+			modes = append(modes, "heat_cool")
+		}
+		climate := haEntity{
+			component:               "climate",
+			key:                     "thermostat",
+			CurrentTemperatureTopic: base + "currentTemperature",
+			CurrentHumidityTopic:    base + "humidityPercent",
+			TemperatureStateTopic:   base + "targetTemperature",
+			ModeStateTopic:          base + "hvacMode",
+			ModeStateTemplate:       haModeStateTemplate,
+			Modes:                   modes,
+			TemperatureUnit:         "C",
+			Precision:               0.1,
+		}
+		if m.writable["targetTemperature"] {
+			climate.TemperatureCommandTopic = m.commandTopic(device, "targetTemperature")
+		}
+		if m.writable["hvacMode"] {
+			climate.ModeCommandTopic = m.commandTopic(device, "hvacMode")
+			climate.ModeCommandTemplate = haModeCommandTemplate
+		}
+		entities = append(entities, climate)
+	case "protect":
+		entities = append(entities,
+			binarySensor("smoke", "Smoke", "smoke", base+"smokeDetected"),
+			binarySensor("co", "Carbon monoxide", "carbon_monoxide", base+"coDetected"),
+			binarySensor("occupancy", "Occupancy", "occupancy", base+"occupancyDetected"),
+		)
+		battery := binarySensor("battery", "Battery", "battery", base+"batteryStatus")
+		battery.PayloadOn, battery.PayloadOff = "low", "normal"
+		entities = append(entities, battery)
+	case "temp_sensor":
+		entities = append(entities, haEntity{
+			component:         "sensor",
+			key:               "temperature",
+			Name:              "Temperature",
+			DeviceClass:       "temperature",
+			StateTopic:        base + "currentTemperature",
+			UnitOfMeasurement: "°C",
+			StateClass:        "measurement",
+		})
+		battery := binarySensor("battery", "Battery", "battery", base+"batteryStatus")
+		battery.PayloadOn, battery.PayloadOff = "low", "normal"
+		entities = append(entities, battery)
+	case "lock":
+		if m.writable["targetState"] {
+			entities = append(entities, haEntity{
+				component:     "lock",
+				key:           "lock",
+				StateTopic:    base + "currentState",
+				CommandTopic:  m.commandTopic(device, "targetState"),
+				PayloadLock:   string(starling.LockStateLocked),
+				PayloadUnlock: string(starling.LockStateUnlocked),
+				StateLocked:   string(starling.LockStateLocked),
+				StateUnlocked: string(starling.LockStateUnlocked),
+			})
+		} else {
+			// The lock device class is on when unlocked.
+			lock := binarySensor("lock", "Lock", "lock", base+"currentState")
+			lock.PayloadOn, lock.PayloadOff = "unlocked", "locked"
+			entities = append(entities, lock)
+		}
+		entities = append(entities, binarySensor("tamper", "Tamper", "tamper", base+"isTampered"))
+	case "cam":
+		entities = append(entities,
+			binarySensor("motion", "Motion", "motion", base+"motionDetected"),
+			binarySensor("person", "Person", "occupancy", base+"personDetected"),
+			binarySensor("sound", "Sound", "sound", base+"soundDetected"),
+			binarySensor("doorbell", "Doorbell", "", base+"doorbellPushed"),
+		)
+	}
+
+	for i := range entities {
+		e := &entities[i]
+		e.UniqueID = "nest_" + device.ID + "_" + e.key
+		e.AvailabilityTopic = m.availabilityTopic()
+		e.Device = haDevice{
+			Identifiers:   []string{"nest_" + device.ID},
+			Name:          device.Name,
+			Manufacturer:  "Google Nest",
+			Model:         device.Type,
+			SerialNumber:  device.SerialNumber,
+			SuggestedArea: device.Where,
+		}
+	}
+	return entities
+}
+
+// publishDiscovery publishes the Home Assistant discovery config of each of the
+// device's entities, if it has changed. m.mu must be held.
+func (m *mqttPublisher) publishDiscovery(device deviceSnapshot) {
+	for _, e := range m.homeAssistantEntities(device) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Err(err).Str("id", device.ID).Msg("error encoding Home Assistant discovery config")
+			continue
+		}
+		topic := m.discoveryPrefix + "/" + e.component + "/" + mqttTopicSegment("nest_"+device.ID) + "/" + e.key + "/config"
+		payload := string(b)
+		if m.published[topic] == payload {
+			continue
+		}
+		if m.send(topic, payload) {
+			m.published[topic] = payload
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/jamesog/nest_exporter/starling"
+	"github.com/jamesog/nest_exporter/temperature"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -9,8 +10,13 @@ import (
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
 
+	"context"
+	"errors"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	flag "github.com/spf13/pflag"
@@ -20,6 +26,9 @@ const (
 	namespace           = "nest"
 	subsystemThermostat = "thermostat"
 	subsystemProtect    = "protect"
+	subsystemCamera     = "camera"
+	subsystemTempSensor = "temperature_sensor"
+	subsystemWeather    = "weather"
 )
 
 var (
@@ -38,12 +47,86 @@ func boolToFloat64(b bool) float64 {
 	return 0
 }
 
+// normaliseState returns state if it is one of states, or "unknown".
+func normaliseState(state string, states []string) string {
+	for _, s := range states {
+		if s == state {
+			return state
+		}
+	}
+	return "unknown"
+}
+
+// stateSetMetrics sends one metric for each of states, with a value of 1 for
+// the current state and 0 for the others.
+func stateSetMetrics(desc *prometheus.Desc, states []string, current string, ch chan<- prometheus.Metric, labelValues ...string) {
+	current = normaliseState(current, states)
+	for _, state := range states {
+		ch <- prometheus.MustNewConstMetric(
+			desc,
+			prometheus.GaugeValue,
+			boolToFloat64(state == current),
+			append(labelValues, state)...,
+		)
+	}
+}
+
+// temperatureDesc describes a temperature metric, which is always exported in
+// celsius and optionally also in fahrenheit.
+type temperatureDesc struct {
+	celsius    *prometheus.Desc
+	fahrenheit *prometheus.Desc
+}
+
+func newTemperatureDesc(subsystem, name, help string, labels []string) temperatureDesc {
+	return temperatureDesc{
+		celsius: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name+"_celsius"),
+			help+" in celsius",
+			labels,
+			nil,
+		),
+		fahrenheit: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name+"_fahrenheit"),
+			help+" in fahrenheit",
+			labels,
+			nil,
+		),
+	}
+}
+
+// metrics sends the temperature, given in celsius, in each unit.
+func (d temperatureDesc) metrics(celsius float64, fahrenheit bool, ch chan<- prometheus.Metric, labelValues ...string) {
+	ch <- prometheus.MustNewConstMetric(
+		d.celsius,
+		prometheus.GaugeValue,
+		celsius,
+		labelValues...,
+	)
+	if fahrenheit {
+		ch <- prometheus.MustNewConstMetric(
+			d.fahrenheit,
+			prometheus.GaugeValue,
+			temperature.CelsiusToFahrenheit(celsius),
+			labelValues...,
+		)
+	}
+}
+
+// Collector exports the hub and devices as they were at the latest background
+// poll, so collecting doesn't make any requests to the Home Hub. If
+// cameraEvents or protectEvents is nil, the event metrics are left out.
 type Collector struct {
-	starlingClient starling.Client
+	store          *deviceStore
+	hvacRuntime    *hvacRuntime
+	cameraEvents   *cameraEventCounter
+	protectEvents  *protectEventTracker
+	fahrenheit     bool
+	genericDevices bool
 }
 
-func NewCollector(client starling.Client) *Collector {
-	return &Collector{client}
+func NewCollector(store *deviceStore, hvac *hvacRuntime, cameraEvents *cameraEventCounter, protectEvents *protectEventTracker, fahrenheit, genericDevices bool) *Collector {
+	return &Collector{store, hvac, cameraEvents, protectEvents, fahrenheit, genericDevices}
 }
 
 func (e Collector) Describe(ch chan<- *prometheus.Desc) {
@@ -51,43 +134,29 @@ func (e Collector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (e Collector) Collect(ch chan<- prometheus.Metric) {
-	status, err := e.starlingClient.Status()
-	if err != nil {
-		log.Err(err).Msg("error fetching status")
-	}
-
-	upValue := 0.0
-	if status != nil && status.APIReady {
-		upValue = 1.0
-	}
 	ch <- prometheus.MustNewConstMetric(
 		up,
 		prometheus.GaugeValue,
-		upValue,
+		boolToFloat64(e.store.hubStatus().Up),
 	)
 
-	devices, err := e.starlingClient.Devices()
-	if err != nil {
-		log.Err(err).Msg("error getting devices")
-		return
-	}
-
-	for _, device := range devices.Devices {
-		switch device.Type {
-		case "thermostat":
-			t, err := e.starlingClient.ThermostatProperties(device.ID)
-			if err != nil {
-				continue
-			}
-			thermostatMetrics(*t, ch)
-		case "protect":
-			t, err := e.starlingClient.ProtectProperties(device.ID)
-			if err != nil {
+	for _, device := range e.store.list() {
+		// Errors fetching the device have already been logged by the poller,
+		// and its properties are out of date.
+		if device.Properties == nil || device.Error != "" {
+			continue
+		}
+		t, ok := deviceTypes[device.Type]
+		if !ok {
+			if !e.genericDevices {
+				log.Warn().Str("type", device.Type).Msg("unsupported device type")
 				continue
 			}
-			protectMetrics(*t, ch)
-		default:
-			log.Warn().Str("type", device.Type).Msg("unsupported device type")
+			log.Debug().Str("type", device.Type).Msg("unsupported device type; exporting generic properties")
+			t = genericDevice{}
+		}
+		if err := t.collect(e, device, ch); err != nil {
+			log.Err(err).Str("id", device.ID).Str("type", device.Type).Msg("error collecting device")
 		}
 	}
 	// TODO: Check status endpoint, return either metric or label for whether connectedToNest is true
@@ -119,6 +188,40 @@ func main() {
 	starlingAPIFlag := flag.String("starling.api", "", "The base URL of the Starling API (overrides STARLING_API_URL)")
 	logLevel := flag.String("log.level", "info", "The level of logging detail")
 	listen := flag.String("listen", ":3081", "The address:port to listen on")
+	pollInterval := flag.Duration("poll.interval", 5*time.Second, "How often to poll devices in the background")
+	fahrenheit := flag.Bool("temperature.fahrenheit", false, "Also export temperatures in fahrenheit")
+	genericDevices := flag.Bool("devices.generic", true, "Export the properties of unsupported device types as nest_device_property metrics")
+	apiControl := flag.Bool("api.control", false, "Allow devices to be changed through the HTTP API (requires NEST_EXPORTER_API_TOKEN)")
+	apiWritable := flag.StringSlice("api.writable-properties", defaultWritableProperties, "Device properties which can be changed through the HTTP API")
+	snapshots := flag.Bool("camera.snapshots", false, "Serve camera snapshots on /camera/{id}/snapshot.jpg (requires NEST_EXPORTER_API_TOKEN)")
+	snapshotTTL := flag.Duration("camera.snapshot-cache", 10*time.Second, "How long to cache camera snapshots for")
+	webhookURLs := flag.StringSlice("webhook.url", nil, "URL to post safety events to (may be repeated)")
+	webhookTemplate := flag.String("webhook.template", "", "File containing a text/template for the webhook payload")
+	webhookSecurity := flag.Bool("webhook.security-events", false, "Also send lock and Detect tampering and Guard state changes to webhooks")
+	webhookRetries := flag.Int("webhook.retries", 3, "How many times to retry delivering a webhook")
+	mqttBroker := flag.String("mqtt.broker", "", "MQTT broker to publish device state to, e.g. tcp://localhost:1883 (MQTT_USERNAME and MQTT_PASSWORD are used if set)")
+	mqttClientID := flag.String("mqtt.client-id", "nest_exporter", "MQTT client ID")
+	mqttPrefix := flag.String("mqtt.topic-prefix", "nest", "Prefix of the MQTT topics to publish to")
+	mqttCommands := flag.Bool("mqtt.commands", false, "Allow devices to be changed through MQTT command topics")
+	mqttWritable := flag.StringSlice("mqtt.writable-properties", defaultMQTTWritableProperties, "Device properties which can be changed through MQTT command topics")
+	mqttDiscovery := flag.Bool("mqtt.discovery", false, "Publish Home Assistant MQTT discovery configs")
+	mqttDiscoveryPrefix := flag.String("mqtt.discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	influxURL := flag.String("influx.url", "", "InfluxDB URL to write device state to as line protocol, or - for stdout (INFLUX_TOKEN is used if set)")
+	influxOrg := flag.String("influx.org", "", "InfluxDB organization to write to")
+	influxBucket := flag.String("influx.bucket", "nest", "InfluxDB bucket to write to")
+	remoteWriteURL := flag.String("remote-write.url", "", "Prometheus remote-write URL to push metrics to after each poll (REMOTE_WRITE_USERNAME and REMOTE_WRITE_PASSWORD, or REMOTE_WRITE_BEARER_TOKEN, are used if set)")
+	remoteWriteQueue := flag.Int("remote-write.queue-size", 1000, "How many remote-write requests to keep while the endpoint can't be reached")
+	promMetrics := flag.Bool("metrics.prometheus", true, "Serve Prometheus metrics on /metrics")
+	otlpEndpoint := flag.String("otlp.endpoint", "", "OTLP/HTTP endpoint to send metrics to after each poll, e.g. http://localhost:4318")
+	otlpHeaders := flag.StringToString("otlp.headers", nil, "Headers to send with OTLP requests, e.g. Authorization=...")
+	historyFile := flag.String("history.file", "", "File to keep a history of device properties in, served on /api/v1/history")
+	historyRetention := flag.Duration("history.retention", 30*24*time.Hour, "How long to keep device property history for")
+	historyInterval := flag.Duration("history.interval", 5*time.Minute, "How often to record device properties whose values haven't changed")
+	once := flag.Bool("once", false, "Collect all devices once, push or write the metrics and exit")
+	pushGateway := flag.String("push.gateway", "", "Pushgateway URL to push metrics to with --once")
+	pushJob := flag.String("push.job", "nest_exporter", "Job name to push metrics to the Pushgateway as")
+	textfile := flag.String("textfile", "", "File to write metrics to with --once, for node_exporter's textfile collector")
+	stateFile := flag.String("state.file", "", "File to persist runtime counters in across restarts")
 	flag.Parse()
 
 	if level, err := zerolog.ParseLevel(*logLevel); err == nil {
@@ -139,11 +242,196 @@ func main() {
 		log.Fatal().Msg("Starling API key not set; must set STARLING_API_URL")
 	}
 
+	if *once {
+		// These need the exporter to keep running, or to see more than one
+		// poll.
+		for _, name := range []string{"listen", "api.control", "camera.snapshots", "webhook.url", "mqtt.broker", "remote-write.url", "otlp.endpoint", "history.file"} {
+			if flag.CommandLine.Changed(name) {
+				log.Fatal().Msg("--" + name + " can't be used with --once")
+			}
+		}
+	}
+
+	hvac, err := newHVACRuntime(*stateFile, *pollInterval)
+	if err != nil {
+		log.Warn().Err(err).Str("path", *stateFile).Msg("couldn't load state file; runtime counters start from zero")
+	}
+
 	client := starling.NewClient(starlingAPI, starlingAPIKey)
-	c := NewCollector(client)
+	// hub identifies the Home Hub in the landing page and OTLP resources.
+	hub := starlingAPI
+	if u, err := url.Parse(starlingAPI); err == nil && u.Host != "" {
+		hub = u.Host
+	}
+
+	store := newDeviceStore()
+	changes := newChangeBroker()
+	p := newPoller(client, *pollInterval, store, changes)
+	p.handle("thermostat", func(properties any, at time.Time) {
+		hvac.observe(*properties.(*starling.ThermostatProperties), at)
+	})
+	// Events are counted between polls, so with --once they would always be
+	// 0 and are left out instead.
+	var (
+		cameraEvents  *cameraEventCounter
+		protectEvents *protectEventTracker
+	)
+	if !*once {
+		cameraEvents = newCameraEventCounter()
+		p.handle("cam", func(properties any, _ time.Time) {
+			cameraEvents.observe(*properties.(*starling.CameraProperties))
+		})
+		protectEvents = newProtectEventTracker()
+		p.handle("protect", func(properties any, at time.Time) {
+			protectEvents.observe(*properties.(*starling.ProtectProperties), at)
+		})
+	}
+	if len(*webhookURLs) > 0 {
+		n, err := newWebhookNotifier(*webhookURLs, *webhookTemplate, *webhookSecurity, *webhookRetries)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid webhook configuration")
+		}
+		prometheus.MustRegister(webhookFailures)
+		go n.run(context.Background(), changes)
+		p.afterPoll(n.initial)
+	}
+	if *mqttBroker != "" {
+		cfg := mqttConfig{
+			Broker:      *mqttBroker,
+			ClientID:    *mqttClientID,
+			Username:    os.Getenv("MQTT_USERNAME"),
+			Password:    os.Getenv("MQTT_PASSWORD"),
+			TopicPrefix: *mqttPrefix,
+		}
+		if *mqttCommands {
+			cfg.Writable = *mqttWritable
+		}
+		if *mqttDiscovery {
+			cfg.DiscoveryPrefix = *mqttDiscoveryPrefix
+		}
+		m, err := newMQTTPublisher(cfg, client)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid --mqtt.writable-properties")
+		}
+		p.afterPoll(m.publish)
+	}
+
+	c := NewCollector(store, hvac, cameraEvents, protectEvents, *fahrenheit, *genericDevices)
+	log.Info().Strs("types", supportedDeviceTypes()).Msg("supported device types")
 	prometheus.MustRegister(collectors.NewBuildInfoCollector())
+	prometheus.MustRegister(changesDropped)
 	prometheus.MustRegister(c)
+	// deviceMetrics gathers only the device metrics, without the exporter's own,
+	// for the outputs which write them elsewhere.
+	deviceMetrics := prometheus.NewRegistry()
+	deviceMetrics.MustRegister(c)
+
+	if *influxURL != "" {
+		w, err := newInfluxWriter(influxConfig{
+			URL:    *influxURL,
+			Org:    *influxOrg,
+			Bucket: *influxBucket,
+			Token:  os.Getenv("INFLUX_TOKEN"),
+		}, deviceMetrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid InfluxDB configuration")
+		}
+		p.afterPoll(w.write)
+	}
+
+	if *once {
+		err := runOnce(context.Background(), p, c, *pushGateway, *pushJob, *textfile)
+		hvac.flush()
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		return
+	}
 
-	http.Handle("/metrics", requestLog(promhttp.Handler()))
-	log.Fatal().Err(http.ListenAndServe(*listen, nil)).Send()
+	// Stop on SIGINT or SIGTERM, saving the runtime counters first.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go hvac.run(ctx)
+
+	if *remoteWriteURL != "" {
+		w, err := newRemoteWriter(remoteWriteConfig{
+			URL:       *remoteWriteURL,
+			Username:  os.Getenv("REMOTE_WRITE_USERNAME"),
+			Password:  os.Getenv("REMOTE_WRITE_PASSWORD"),
+			Token:     os.Getenv("REMOTE_WRITE_BEARER_TOKEN"),
+			QueueSize: *remoteWriteQueue,
+		}, prometheus.DefaultGatherer)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid remote-write configuration")
+		}
+		prometheus.MustRegister(remoteWriteDropped)
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "remote_write",
+				Name:      "queue_length",
+				Help:      "Number of remote-write requests waiting to be sent",
+			},
+			w.queueLength,
+		))
+		p.afterPoll(w.enqueue)
+		go w.run(context.Background())
+	}
+	var history *historyStore
+	if *historyFile != "" {
+		history, err = newHistoryStore(*historyFile, *historyRetention, *historyInterval)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", *historyFile).Send()
+		}
+		p.afterPoll(history.record)
+	}
+	if *otlpEndpoint != "" {
+		e, err := newOTLPExporter(*otlpEndpoint, *otlpHeaders, hub, deviceMetrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid OTLP configuration")
+		}
+		p.afterPoll(e.export)
+	}
+	go p.run(context.Background())
+
+	if *promMetrics {
+		http.Handle("/metrics", requestLog(promhttp.Handler()))
+	}
+	http.Handle("/", requestLog(landingPage{store: store, hub: hub, metrics: *promMetrics}))
+
+	token := os.Getenv("NEST_EXPORTER_API_TOKEN")
+	var apiToken string
+	if *apiControl {
+		if token == "" {
+			log.Fatal().Msg("API token not set; must set NEST_EXPORTER_API_TOKEN to use --api.control")
+		}
+		apiToken = token
+	}
+	api, err := newAPIServer(client, store, changes, apiToken, *apiWritable)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --api.writable-properties")
+	}
+	http.Handle("/api/v1/devices", requestLog(http.HandlerFunc(api.devices)))
+	http.Handle("/api/v1/devices/", requestLog(http.HandlerFunc(api.device)))
+	http.Handle("/api/v1/events", requestLog(http.HandlerFunc(api.events)))
+	if history != nil {
+		http.Handle("/api/v1/history", requestLog(http.HandlerFunc(history.handler)))
+	}
+	if *snapshots {
+		if token == "" {
+			log.Fatal().Msg("API token not set; must set NEST_EXPORTER_API_TOKEN to use --camera.snapshots")
+		}
+		http.Handle("/camera/", requestLog(newSnapshotProxy(client, store, token, *snapshotTTL)))
+	}
+
+	srv := &http.Server{Addr: *listen}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal().Err(err).Send()
+	}
+	hvac.flush()
+	log.Info().Msg("stopped")
 }
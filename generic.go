@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	genericLabels = []string{"id", "type", "property"}
+
+	genericProperty = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "property"),
+		"Numeric or boolean property of a device type which isn't otherwise supported",
+		genericLabels,
+		nil,
+	)
+	genericPropertyInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "device", "property_info"),
+		"String property of a device type which isn't otherwise supported",
+		append(genericLabels, "value"),
+		nil,
+	)
+)
+
+// genericDevice is the deviceType used for devices whose type isn't
+// registered. It exports every property Starling returns for the device,
+// so that new device types are visible before they are supported properly.
+type genericDevice struct{}
+
+// fetch returns the device's properties as a map[string]any.
+func (genericDevice) fetch(ctx context.Context, client starling.Client, id string) (any, error) {
+	properties, err := starling.DeviceProperties[map[string]any](ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	return *properties, nil
+}
+
+func (genericDevice) collect(c Collector, device deviceSnapshot, ch chan<- prometheus.Metric) error {
+	properties, ok := device.Properties.(map[string]any)
+	if !ok {
+		return fmt.Errorf("unexpected properties type %T", device.Properties)
+	}
+	genericMetrics(device.CommonProperties, properties, ch)
+	return nil
+}
+
+// genericMetrics sends a metric for each property. Numbers and booleans are
+// exported as their value, strings as the value label of an info metric.
+// Anything else, such as nested objects, is skipped.
+func genericMetrics(device starling.CommonProperties, properties map[string]any, ch chan<- prometheus.Metric) {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch v := properties[name].(type) {
+		case float64:
+			ch <- prometheus.MustNewConstMetric(
+				genericProperty,
+				prometheus.GaugeValue,
+				v,
+				device.ID, device.Type, name,
+			)
+		case bool:
+			ch <- prometheus.MustNewConstMetric(
+				genericProperty,
+				prometheus.GaugeValue,
+				boolToFloat64(v),
+				device.ID, device.Type, name,
+			)
+		case string:
+			ch <- prometheus.MustNewConstMetric(
+				genericPropertyInfo,
+				prometheus.GaugeValue,
+				1,
+				device.ID, device.Type, name, v,
+			)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// historyPruneInterval is how often samples older than the retention
+	// period are deleted.
+	historyPruneInterval = time.Hour
+	// historyDefaultRange is the range queried if from isn't given.
+	historyDefaultRange = 24 * time.Hour
+	// historyMaxPoints is the most points a query returns by default.
+	historyMaxPoints = 500
+)
+
+// historyStore keeps a rolling history of the numeric and boolean properties
+// of each device, as seen by the poller, in a bolt database.
+//
+// Each device has a bucket holding a bucket per property. Samples are keyed by
+// their time in nanoseconds since the epoch, big-endian so that they sort in
+// time order, and booleans are stored as 0 or 1. A property is recorded when
+// its value changes, and otherwise only once per interval, so that the
+// database doesn't grow with every poll.
+type historyStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	interval  time.Duration
+
+	mu       sync.Mutex
+	recorded map[string]time.Time
+	// last is the last sample recorded for each property of each device.
+	last       map[string]map[string]historySample
+	lastPruned time.Time
+}
+
+type historySample struct {
+	at    time.Time
+	value []byte
+}
+
+func newHistoryStore(path string, retention, interval time.Duration) (*historyStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open history database: %w", err)
+	}
+	return &historyStore{
+		db:        db,
+		retention: retention,
+		interval:  interval,
+		recorded:  make(map[string]time.Time),
+		last:      make(map[string]map[string]historySample),
+	}, nil
+}
+
+// record stores the properties of each device which have changed since they
+// were last recorded, or which were last recorded at least an interval ago.
+// It's called by the poller after each poll.
+func (h *historyStore) record(_ hubStatus, devices []deviceSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// samples holds the new samples of each property of each device.
+	samples := make(map[string]map[string]historySample)
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		seen[device.ID] = true
+		if device.Properties == nil || h.recorded[device.ID].Equal(device.FetchedAt) {
+			continue
+		}
+		properties, err := propertiesMap(device.Properties)
+		if err != nil {
+			log.Err(err).Str("id", device.ID).Msg("error converting device properties")
+			continue
+		}
+		h.recorded[device.ID] = device.FetchedAt
+
+		last := h.last[device.ID]
+		if last == nil {
+			last = make(map[string]historySample)
+			h.last[device.ID] = last
+		}
+		for name, value := range properties {
+			v, ok := historyValue(value)
+			if !ok {
+				continue
+			}
+			prev, ok := last[name]
+			if ok && bytes.Equal(prev.value, v) && device.FetchedAt.Sub(prev.at) < h.interval {
+				continue
+			}
+			sample := historySample{at: device.FetchedAt, value: v}
+			last[name] = sample
+			if samples[device.ID] == nil {
+				samples[device.ID] = make(map[string]historySample)
+			}
+			samples[device.ID][name] = sample
+		}
+	}
+	for id := range h.recorded {
+		if !seen[id] {
+			delete(h.recorded, id)
+			delete(h.last, id)
+		}
+	}
+
+	if len(samples) > 0 {
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			for id, properties := range samples {
+				b, err := tx.CreateBucketIfNotExists([]byte(id))
+				if err != nil {
+					return err
+				}
+				for name, sample := range properties {
+					pb, err := b.CreateBucketIfNotExists([]byte(name))
+					if err != nil {
+						return err
+					}
+					if err := pb.Put(historyKey(sample.at), sample.value); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Err(err).Msg("error recording history")
+			// Record every property again after the next poll.
+			h.recorded = make(map[string]time.Time)
+			h.last = make(map[string]map[string]historySample)
+		}
+	}
+
+	if now := time.Now(); now.Sub(h.lastPruned) >= historyPruneInterval {
+		if err := h.prune(now.Add(-h.retention)); err != nil {
+			log.Err(err).Msg("error pruning history")
+		}
+		h.lastPruned = now
+	}
+}
+
+// prune deletes samples from before cutoff. Each device is pruned in its own
+// transaction, so that the database isn't held for long.
+func (h *historyStore) prune(cutoff time.Time) error {
+	var ids [][]byte
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(id []byte, _ *bolt.Bucket) error {
+			ids = append(ids, append([]byte(nil), id...))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	end := historyKey(cutoff)
+	for _, id := range ids {
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			device := tx.Bucket(id)
+			if device == nil {
+				return nil
+			}
+			return device.ForEach(func(name, _ []byte) error {
+				pb := device.Bucket(name)
+				if pb == nil {
+					return nil
+				}
+				// Deleting with the cursor while iterating skips keys, so
+				// the keys are collected first.
+				var old [][]byte
+				c := pb.Cursor()
+				for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+					old = append(old, k)
+				}
+				for _, k := range old {
+					if err := pb.Delete(k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func historyKey(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+// historyValue encodes a property value if it's a number or boolean.
+func historyValue(value any) ([]byte, bool) {
+	var v float64
+	switch value := value.(type) {
+	case float64:
+		v = value
+	case bool:
+		if value {
+			v = 1
+		}
+	default:
+		return nil, false
+	}
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(v)), true
+}
+
+// historyPoint is the aggregate of the samples in one step of a query.
+type historyPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+}
+
+var errNoHistory = errors.New("no history for device property")
+
+// query returns the samples of a property between from and to, averaged over
+// each step. Steps without samples are left out.
+func (h *historyStore) query(id, property string, from, to time.Time, step time.Duration) ([]historyPoint, error) {
+	points := []historyPoint{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket([]byte(id))
+		if device == nil {
+			return errNoHistory
+		}
+		pb := device.Bucket([]byte(property))
+		if pb == nil {
+			return errNoHistory
+		}
+
+		var (
+			current historyPoint
+			count   int
+		)
+		flush := func() {
+			if count > 0 {
+				current.Value /= float64(count)
+				points = append(points, current)
+			}
+		}
+
+		end := historyKey(to)
+		c := pb.Cursor()
+		for k, v := c.Seek(historyKey(from)); k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+			value := math.Float64frombits(binary.BigEndian.Uint64(v))
+			start := from.Add(at.Sub(from) / step * step)
+			if count == 0 || !start.Equal(current.Time) {
+				flush()
+				current = historyPoint{Time: start, Min: value, Max: value}
+				count = 0
+			}
+			current.Value += value
+			current.Min = math.Min(current.Min, value)
+			current.Max = math.Max(current.Max, value)
+			count++
+		}
+		flush()
+		return nil
+	})
+	return points, err
+}
+
+// handler serves /api/v1/history?device=&property=&from=&to=&step=. from and
+// to are RFC 3339 times or Unix timestamps, and default to the last 24 hours.
+// step is a duration; if it's not given, one is chosen so that at most 500
+// points are returned.
+func (h *historyStore) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	id, property := q.Get("device"), q.Get("property")
+	if id == "" || property == "" {
+		writeAPIError(w, http.StatusBadRequest, "device and property are required")
+		return
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := parseHistoryTime(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+		to = t
+	}
+	from := to.Add(-historyDefaultRange)
+	if v := q.Get("from"); v != "" {
+		t, err := parseHistoryTime(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		writeAPIError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	step := to.Sub(from) / historyMaxPoints
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid step: "+err.Error())
+			return
+		}
+		step = d
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+
+	points, err := h.query(id, property, from, to, step)
+	switch {
+	case errors.Is(err, errNoHistory):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		hlog.FromRequest(r).Err(err).Msg("error querying history")
+		writeAPIError(w, http.StatusInternalServerError, "error querying history")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]any{
+		"device":   id,
+		"property": property,
+		"from":     from,
+		"to":       to,
+		"step":     step.Seconds(),
+		"points":   points,
+	})
+}
+
+// parseHistoryTime parses an RFC 3339 time or a Unix timestamp in seconds.
+func parseHistoryTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// hvacMaxInterval is the longest gap between two polls that is counted
+	// as runtime, unless the poll interval is longer. Anything longer (e.g.
+	// the exporter was stopped) is discarded rather than attributed to
+	// whatever state the thermostat was last seen in.
+	hvacMaxInterval = 15 * time.Minute
+	// hvacSaveInterval is how often the counters are saved to the state file
+	// if they've changed.
+	hvacSaveInterval = time.Minute
+)
+
+// hvacRuntime accumulates how long each thermostat has spent heating, cooling
+// and running its fan, based on the state seen at each poll.
+type hvacRuntime struct {
+	mu          sync.Mutex
+	path        string
+	maxInterval time.Duration
+	devices     map[string]*hvacDeviceRuntime
+	// dirty is true if the counters have changed since they were saved.
+	dirty bool
+}
+
+type hvacDeviceRuntime struct {
+	LastSeen       time.Time `json:"last_seen"`
+	HVACState      string    `json:"hvac_state"`
+	FanRunning     bool      `json:"fan_running"`
+	HeatingSeconds float64   `json:"heating_seconds"`
+	CoolingSeconds float64   `json:"cooling_seconds"`
+	FanSeconds     float64   `json:"fan_seconds"`
+}
+
+// newHVACRuntime returns a runtime tracker for thermostats polled every
+// pollInterval. If path is not empty, previously saved counters are loaded
+// from it, and the counters are saved back to it by run and flush.
+func newHVACRuntime(path string, pollInterval time.Duration) (*hvacRuntime, error) {
+	r := &hvacRuntime{
+		path:        path,
+		maxInterval: hvacMaxInterval,
+		devices:     make(map[string]*hvacDeviceRuntime),
+	}
+	// Allow for a missed poll or two when polling less often than the
+	// default limit.
+	if limit := 3 * pollInterval; limit > r.maxInterval {
+		r.maxInterval = limit
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(b, &r.devices); err != nil {
+		r.devices = make(map[string]*hvacDeviceRuntime)
+		return r, err
+	}
+	return r, nil
+}
+
+// observe records the current state of the thermostat. The time since the
+// previous poll is attributed to the state seen at the previous poll. It's
+// called by the background poller.
+func (r *hvacRuntime) observe(t starling.ThermostatProperties, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[t.ID]
+	if !ok {
+		d = &hvacDeviceRuntime{}
+		r.devices[t.ID] = d
+	}
+
+	if !d.LastSeen.IsZero() {
+		elapsed := now.Sub(d.LastSeen)
+		if elapsed > 0 && elapsed <= r.maxInterval {
+			switch d.HVACState {
+			case "heating":
+				d.HeatingSeconds += elapsed.Seconds()
+			case "cooling":
+				d.CoolingSeconds += elapsed.Seconds()
+			}
+			if d.FanRunning {
+				d.FanSeconds += elapsed.Seconds()
+			}
+		}
+	}
+	d.LastSeen = now
+	d.HVACState = t.HVACState
+	d.FanRunning = t.FanRunning
+	r.dirty = true
+}
+
+// run saves the counters every hvacSaveInterval until ctx is cancelled, so
+// that the state file isn't rewritten on every poll.
+func (r *hvacRuntime) run(ctx context.Context) {
+	if r.path == "" {
+		return
+	}
+	ticker := time.NewTicker(hvacSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush saves the counters if they've changed since they were last saved.
+func (r *hvacRuntime) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.path == "" || !r.dirty {
+		return
+	}
+	if err := r.save(); err != nil {
+		log.Err(err).Str("path", r.path).Msg("error saving HVAC runtime state")
+		return
+	}
+	r.dirty = false
+}
+
+// get returns the accumulated runtime of the thermostat.
+func (r *hvacRuntime) get(id string) hvacDeviceRuntime {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d, ok := r.devices[id]; ok {
+		return *d
+	}
+	return hvacDeviceRuntime{}
+}
+
+// save writes the counters to r.path.
+func (r *hvacRuntime) save() error {
+	b, err := json.Marshal(r.devices)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, b)
+}
+
+// writeFileAtomic writes b to a temporary file next to path and renames it
+// into place, so that a crash never leaves a truncated file behind.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+// influxWriter writes the exporter's metrics as InfluxDB line protocol after
+// each poll, either to an InfluxDB v2 write endpoint or to stdout.
+//
+// Each device type is a measurement named nest_<type>, tagged with the
+// device's id, name, where and structure and any other labels of the metric.
+// Each metric is a field named without the nest_ and subsystem prefixes, e.g.
+// heating_seconds_total. Metrics without an id label, such as nest_up, are
+// written to the nest_hub measurement. The properties of generic devices are
+// fields named after the property, with strings as string fields rather than
+// tags, so that each value doesn't create a new series.
+type influxWriter struct {
+	// writeURL is the InfluxDB write endpoint. If it's empty, lines are
+	// written to out instead.
+	writeURL string
+	token    string
+	client   *http.Client
+	out      io.Writer
+	gatherer prometheus.Gatherer
+
+	// written is the fetch time of each device's properties when they were
+	// last written, so that a device whose fetch failed isn't written again.
+	written map[string]time.Time
+}
+
+type influxConfig struct {
+	// URL is the base URL of InfluxDB, or "-" to write to stdout.
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+}
+
+// newInfluxWriter returns a writer which writes the metrics from gatherer.
+func newInfluxWriter(cfg influxConfig, gatherer prometheus.Gatherer) (*influxWriter, error) {
+	w := &influxWriter{
+		token:    cfg.Token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		out:      os.Stdout,
+		gatherer: gatherer,
+		written:  make(map[string]time.Time),
+	}
+	if cfg.URL == "-" {
+		return w, nil
+	}
+
+	u, err := url.ParseRequestURI(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("InfluxDB bucket not set")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = url.Values{
+		"org":       {cfg.Org},
+		"bucket":    {cfg.Bucket},
+		"precision": {"ns"},
+	}.Encode()
+	w.writeURL = u.String()
+	return w, nil
+}
+
+// write gathers the metrics and writes them. It's called by the poller after
+// each poll, with the devices used to find each device's type and tags.
+func (w *influxWriter) write(status hubStatus, devices []deviceSnapshot) {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		log.Warn().Err(err).Msg("error gathering metrics for InfluxDB")
+	}
+	byID := make(map[string]deviceSnapshot, len(devices))
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+
+	// lines holds a line for each measurement and set of tags, as metrics
+	// with the same labels are fields of the same point.
+	lines := make(map[string]*influxLine)
+	written := make(map[string]time.Time)
+	for _, family := range families {
+		field := influxFieldName(family.GetName())
+		for _, m := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			line := influxLine{measurement: "nest_hub", at: status.FetchedAt}
+			tags := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				tags[l.GetName()] = l.GetValue()
+			}
+			fieldName, fieldValue := field, any(value)
+			switch family.GetName() {
+			case "nest_device_property", "nest_device_property_info":
+				// The type is the measurement already, and the device's
+				// name and location are tags.
+				fieldName = tags["property"]
+				switch fieldName {
+				case "id", "type", "name", "where", "structureName":
+					continue
+				}
+				if v, ok := tags["value"]; ok {
+					fieldValue = v
+				}
+				delete(tags, "type")
+				delete(tags, "property")
+				delete(tags, "value")
+			}
+			if id, ok := tags["id"]; ok {
+				device, ok := byID[id]
+				if !ok || w.written[id].Equal(device.FetchedAt) {
+					continue
+				}
+				line = influxLine{measurement: "nest_" + device.Type, at: device.FetchedAt}
+				tags["name"] = device.Name
+				tags["structure"] = device.StructureName
+				tags["where"] = device.Where
+				written[id] = device.FetchedAt
+			}
+			for key, value := range tags {
+				line.tag(key, value)
+			}
+			sort.Strings(line.tags)
+
+			key := line.measurement + "," + strings.Join(line.tags, ",")
+			if _, ok := lines[key]; !ok {
+				lines[key] = &line
+			}
+			lines[key].field(fieldName, fieldValue)
+		}
+	}
+	if status.Status != nil {
+		hub := lines["nest_hub,"]
+		if hub == nil {
+			hub = &influxLine{measurement: "nest_hub", at: status.FetchedAt}
+			lines["nest_hub,"] = hub
+		}
+		hub.field("apiVersion", status.APIVersion)
+		hub.field("connectedToNest", status.ConnectedToNest)
+	}
+
+	keys := make([]string, 0, len(lines))
+	for key := range lines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(lines[key].String())
+	}
+
+	for id, at := range written {
+		w.written[id] = at
+	}
+	for id := range w.written {
+		if _, ok := byID[id]; !ok {
+			delete(w.written, id)
+		}
+	}
+
+	if w.writeURL == "" {
+		if _, err := w.out.Write(buf.Bytes()); err != nil {
+			log.Err(err).Msg("error writing line protocol")
+		}
+		return
+	}
+	if err := w.post(buf.Bytes()); err != nil {
+		log.Err(err).Msg("error writing to InfluxDB")
+		// Try the devices again after the next poll.
+		w.written = make(map[string]time.Time)
+	}
+}
+
+func (w *influxWriter) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// influxLine is a single point in line protocol.
+type influxLine struct {
+	measurement string
+	tags        []string
+	fields      []string
+	at          time.Time
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, `\`, `\\`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, `\`, `\\`)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// tag adds a tag. Tags with empty values aren't allowed by line protocol, so
+// they're left out.
+func (l *influxLine) tag(key, value string) {
+	if value == "" {
+		return
+	}
+	l.tags = append(l.tags, influxKeyEscaper.Replace(key)+"="+influxKeyEscaper.Replace(value))
+}
+
+// field adds a field if value is a number, boolean or string. Numbers are
+// always written as floats, so that a field's type doesn't change depending
+// on its value.
+func (l *influxLine) field(key string, value any) {
+	var v string
+	switch value := value.(type) {
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		v = strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		v = strconv.FormatBool(value)
+	case string:
+		v = `"` + influxStringEscaper.Replace(value) + `"`
+	default:
+		return
+	}
+	l.fields = append(l.fields, influxKeyEscaper.Replace(key)+"="+v)
+}
+
+// influxSubsystems are the subsystems of metric names, which are left out of
+// field names as the measurement already gives the device type.
+var influxSubsystems = []string{
+	subsystemThermostat,
+	subsystemProtect,
+	subsystemCamera,
+	subsystemTempSensor,
+	subsystemWeather,
+	"device",
+}
+
+// influxFieldName returns the field name of a metric, e.g. heating_seconds_total
+// for nest_thermostat_heating_seconds_total.
+func influxFieldName(metric string) string {
+	name := strings.TrimPrefix(metric, namespace+"_")
+	for _, subsystem := range influxSubsystems {
+		if strings.HasPrefix(name, subsystem+"_") {
+			return strings.TrimPrefix(name, subsystem+"_")
+		}
+	}
+	return name
+}
+
+func (l influxLine) String() string {
+	sort.Strings(l.tags)
+	sort.Strings(l.fields)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(l.measurement))
+	for _, tag := range l.tags {
+		b.WriteString(",")
+		b.WriteString(tag)
+	}
+	b.WriteString(" ")
+	b.WriteString(strings.Join(l.fields, ","))
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(l.at.UnixNano(), 10))
+	b.WriteString("\n")
+	return b.String()
+}
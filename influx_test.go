@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInfluxLine(t *testing.T) {
+	at := time.Unix(0, 1700000000000000000)
+	tests := []struct {
+		name string
+		line func() influxLine
+		want string
+	}{
+		{
+			name: "plain",
+			line: func() influxLine {
+				l := influxLine{measurement: "nest_thermostat", at: at}
+				l.tag("where", "Hall")
+				l.tag("id", "t1")
+				l.field("is_heating", 1.0)
+				l.field("current_temperature_celsius", 20.5)
+				return l
+			},
+			want: "nest_thermostat,id=t1,where=Hall current_temperature_celsius=20.5,is_heating=1 1700000000000000000\n",
+		},
+		{
+			name: "tag escaping",
+			line: func() influxLine {
+				l := influxLine{measurement: "nest_thermostat", at: at}
+				l.tag("name", "Living room, upstairs")
+				l.tag("where", "a=b")
+				l.tag("structure", `C:\Home\`)
+				l.tag("tag key", "v")
+				l.field("up", 1.0)
+				return l
+			},
+			want: `nest_thermostat,name=Living\ room\,\ upstairs,structure=C:\\Home\\,tag\ key=v,where=a\=b up=1 1700000000000000000` + "\n",
+		},
+		{
+			name: "field escaping",
+			line: func() influxLine {
+				l := influxLine{measurement: "nest_device", at: at}
+				l.field("field, key=x", 2.0)
+				l.field("mode", `say "hi" \ bye`)
+				l.field("on", true)
+				return l
+			},
+			want: `nest_device field\,\ key\=x=2,mode="say \"hi\" \\ bye",on=true 1700000000000000000` + "\n",
+		},
+		{
+			name: "measurement escaping",
+			line: func() influxLine {
+				l := influxLine{measurement: `nest device,x\`, at: at}
+				l.field("up", 0.0)
+				return l
+			},
+			want: `nest\ device\,x\\ up=0 1700000000000000000` + "\n",
+		},
+		{
+			name: "skipped values",
+			line: func() influxLine {
+				l := influxLine{measurement: "nest_hub", at: at}
+				l.tag("empty", "")
+				l.field("nan", math.NaN())
+				l.field("inf", math.Inf(1))
+				l.field("list", []any{1.0})
+				l.field("up", 1.0)
+				return l
+			},
+			want: "nest_hub up=1 1700000000000000000\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.line().String(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxFieldName(t *testing.T) {
+	tests := map[string]string{
+		"nest_up":                                     "up",
+		"nest_thermostat_heating_seconds_total":       "heating_seconds_total",
+		"nest_temperature_sensor_temperature_celsius": "temperature_celsius",
+		"nest_camera_events_total":                    "events_total",
+		"nest_device_property":                        "property",
+	}
+	for metric, want := range tests {
+		if got := influxFieldName(metric); got != want {
+			t.Errorf("influxFieldName(%q) = %q, want %q", metric, got, want)
+		}
+	}
+}
+
+func TestInfluxWriteGeneric(t *testing.T) {
+	at := time.Unix(0, 1700000000000000000)
+	property := func(name string, value float64, labels ...string) *dto.Metric {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: ptr(value)}}
+		labels = append([]string{"id", "l1", "type", "lock", "property", name}, labels...)
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: ptr(labels[i]), Value: ptr(labels[i+1])})
+		}
+		return m
+	}
+	families := []*dto.MetricFamily{
+		{
+			Name: ptr("nest_device_property"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				property("batteryLevel", 80),
+				property("jammed", 0),
+			},
+		},
+		{
+			Name: ptr("nest_device_property_info"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				property("currentState", 1, "value", "unlocked"),
+				property("name", 1, "value", "Front door"),
+				property("type", 1, "value", "lock"),
+			},
+		},
+	}
+	devices := []deviceSnapshot{{
+		CommonProperties: starling.CommonProperties{ID: "l1", Type: "lock", Name: "Front door", Where: "Hall"},
+		FetchedAt:        at,
+	}}
+
+	var buf bytes.Buffer
+	w := &influxWriter{
+		out: &buf,
+		gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, nil
+		}),
+		written: make(map[string]time.Time),
+	}
+	w.write(hubStatus{FetchedAt: at}, devices)
+
+	want := `nest_lock,id=l1,name=Front\ door,where=Hall batteryLevel=80,currentState="unlocked",jammed=0 1700000000000000000` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
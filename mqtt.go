@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/log"
+)
+
+// mqttPublisher publishes the properties of each device to MQTT as retained
+// messages, on topics of the form <prefix>/<structure>/<type>/<id>/<property>.
+// Only properties which have changed since they were last published are sent.
+//
+// If discoveryPrefix is set, Home Assistant MQTT discovery configs are also
+// published for each device. If any properties are writable, they can be set
+// by publishing to the property's topic with /set appended.
+type mqttPublisher struct {
+	client          mqtt.Client
+	starlingClient  starling.Client
+	prefix          string
+	discoveryPrefix string
+	writable        map[string]bool
+
+	mu        sync.Mutex
+	published map[string]string
+	online    string
+
+	// devices maps the topic of each device from the latest poll to the
+	// device, so that commands can only be sent to devices which exist.
+	devicesMu sync.Mutex
+	devices   map[string]deviceSnapshot
+}
+
+type mqttConfig struct {
+	Broker          string
+	ClientID        string
+	Username        string
+	Password        string
+	TopicPrefix     string
+	DiscoveryPrefix string
+	// Writable are the properties which can be set through command topics.
+	Writable []string
+}
+
+// newMQTTPublisher connects to the broker. If the broker can't be reached,
+// the client keeps trying to connect in the background.
+func newMQTTPublisher(cfg mqttConfig, client starling.Client) (*mqttPublisher, error) {
+	m := &mqttPublisher{
+		starlingClient:  client,
+		prefix:          strings.TrimSuffix(cfg.TopicPrefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(cfg.DiscoveryPrefix, "/"),
+		writable:        make(map[string]bool, len(cfg.Writable)),
+		published:       make(map[string]string),
+		devices:         make(map[string]deviceSnapshot),
+	}
+	for _, property := range cfg.Writable {
+		if err := validMQTTWritable(property); err != nil {
+			return nil, err
+		}
+		m.writable[property] = true
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetWill(m.availabilityTopic(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Err(err).Msg("lost connection to MQTT broker")
+		})
+	m.client = mqtt.NewClient(opts)
+	m.client.Connect()
+	return m, nil
+}
+
+func (m *mqttPublisher) availabilityTopic() string {
+	return m.prefix + "/status"
+}
+
+// onConnect forgets what has been published, so that the full state is sent
+// again after the next poll in case the broker lost its retained messages.
+func (m *mqttPublisher) onConnect(client mqtt.Client) {
+	log.Info().Msg("connected to MQTT broker")
+	m.mu.Lock()
+	m.published = make(map[string]string)
+	m.online = ""
+	m.mu.Unlock()
+
+	if len(m.writable) > 0 {
+		m.subscribeCommands(client)
+	}
+}
+
+// publish sends the hub's availability and any device properties which have
+// changed. It's called by the poller after each poll.
+func (m *mqttPublisher) publish(status hubStatus, devices []deviceSnapshot) {
+	byTopic := make(map[string]deviceSnapshot, len(devices))
+	for _, device := range devices {
+		byTopic[m.deviceTopic(device)] = device
+	}
+	m.devicesMu.Lock()
+	m.devices = byTopic
+	m.devicesMu.Unlock()
+
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	online := "offline"
+	if status.Up {
+		online = "online"
+	}
+	if online != m.online {
+		m.send(m.availabilityTopic(), online)
+		m.online = online
+	}
+
+	for _, device := range devices {
+		if device.Properties == nil {
+			continue
+		}
+		properties, err := propertiesMap(device.Properties)
+		if err != nil {
+			log.Err(err).Str("id", device.ID).Msg("error converting device properties")
+			continue
+		}
+
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if m.discoveryPrefix != "" {
+			m.publishDiscovery(device)
+		}
+
+		base := m.deviceTopic(device)
+		for _, name := range names {
+			payload, err := mqttPayload(properties[name])
+			if err != nil {
+				log.Err(err).Str("id", device.ID).Str("property", name).Msg("error encoding property")
+				continue
+			}
+			topic := base + "/" + mqttTopicSegment(name)
+			if m.published[topic] == payload {
+				continue
+			}
+			if m.send(topic, payload) {
+				m.published[topic] = payload
+			}
+		}
+	}
+}
+
+// deviceTopic returns the topic under which the device's properties are
+// published.
+func (m *mqttPublisher) deviceTopic(device deviceSnapshot) string {
+	return strings.Join([]string{
+		m.prefix,
+		mqttTopicSegment(device.StructureName),
+		mqttTopicSegment(device.Type),
+		mqttTopicSegment(device.ID),
+	}, "/")
+}
+
+// send publishes a retained message, reporting whether it was accepted by the
+// broker.
+func (m *mqttPublisher) send(topic, payload string) bool {
+	token := m.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		log.Warn().Str("topic", topic).Msg("timed out publishing to MQTT")
+		return false
+	}
+	if err := token.Error(); err != nil {
+		log.Err(err).Str("topic", topic).Msg("error publishing to MQTT")
+		return false
+	}
+	return true
+}
+
+// mqttTopicSegment replaces the characters which have special meaning in MQTT
+// topics.
+func mqttTopicSegment(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// mqttPayload formats a property value. Strings are sent as they are and
+// anything else as JSON.
+func mqttPayload(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode %v: %w", v, err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/log"
+)
+
+// mqttLockTimeout is how long to wait for a lock to confirm a change
+// requested over MQTT.
+const mqttLockTimeout = 30 * time.Second
+
+// defaultMQTTWritableProperties are the properties which can be set over MQTT
+// unless configured otherwise.
+var defaultMQTTWritableProperties = []string{"targetTemperature", "hvacMode", "targetState"}
+
+// lockStateSetter sets the target state of a lock, failing if the lock
+// doesn't confirm the change.
+func lockStateSetter(ctx context.Context, client starling.Client, id string, value json.RawMessage) error {
+	var state starling.LockState
+	if err := json.Unmarshal(value, &state); err != nil {
+		return errBadValue{err}
+	}
+	result, err := client.SetLockState(ctx, id, state, mqttLockTimeout)
+	if err != nil {
+		return err
+	}
+	if !result.Confirmed {
+		return fmt.Errorf("lock is %s after %s", result.State, result.Elapsed.Round(time.Second))
+	}
+	return nil
+}
+
+// mqttSetter returns the setter for a property of a device type.
+func mqttSetter(deviceType, property string) (propertySetter, bool) {
+	switch {
+	case deviceType == "thermostat":
+		set, ok := propertySetters[property]
+		return set, ok
+	case deviceType == "lock" && property == "targetState":
+		return lockStateSetter, true
+	default:
+		return nil, false
+	}
+}
+
+// validMQTTWritable returns an error if property can't be set on any device
+// type.
+func validMQTTWritable(property string) error {
+	for _, deviceType := range []string{"thermostat", "lock"} {
+		if _, ok := mqttSetter(deviceType, property); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("property %s can't be set", property)
+}
+
+// commandTopic returns the topic a property of a device is set by.
+func (m *mqttPublisher) commandTopic(device deviceSnapshot, property string) string {
+	return m.deviceTopic(device) + "/" + property + "/set"
+}
+
+// subscribeCommands subscribes to the command topics of every device.
+func (m *mqttPublisher) subscribeCommands(client mqtt.Client) {
+	filter := m.prefix + "/+/+/+/+/set"
+	token := client.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		// A retained command would be run again every time the exporter
+		// connects, e.g. unlocking a door after each restart, so retained
+		// commands are ignored and cleared.
+		if msg.Retained() {
+			if len(msg.Payload()) > 0 {
+				log.Warn().Str("topic", msg.Topic()).Msg("ignoring retained MQTT command")
+				client.Publish(msg.Topic(), 1, true, "")
+			}
+			return
+		}
+		// Clearing a retained command delivers an empty message.
+		if len(msg.Payload()) == 0 {
+			return
+		}
+		// Setting a lock can take a while, so don't hold up other messages.
+		go m.handleCommand(msg.Topic(), msg.Payload())
+	})
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		log.Err(token.Error()).Str("topic", filter).Msg("error subscribing to MQTT command topics")
+	}
+}
+
+type mqttAck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleCommand sets the property named by a command topic of the form
+// <prefix>/<structure>/<type>/<id>/<property>/set, then publishes the outcome
+// to the same topic with /ack instead of /set.
+func (m *mqttPublisher) handleCommand(topic string, payload []byte) {
+	parts := strings.Split(strings.TrimPrefix(topic, m.prefix+"/"), "/")
+	if len(parts) != 5 {
+		return
+	}
+	property := parts[3]
+	logger := log.With().Str("topic", topic).Str("property", property).Logger()
+
+	// The topic is chosen by whoever published the command, so the device
+	// must be one from the latest poll with the structure and type given.
+	m.devicesMu.Lock()
+	device, ok := m.devices[strings.TrimSuffix(topic, "/"+property+"/set")]
+	m.devicesMu.Unlock()
+
+	var err error
+	if ok {
+		logger = logger.With().Str("id", device.ID).Logger()
+		err = m.setProperty(device.Type, device.ID, property, payload)
+	} else {
+		err = errors.New("unknown device")
+	}
+	ack := mqttAck{Status: "OK"}
+	if err != nil {
+		logger.Err(err).Msg("error setting property from MQTT")
+		ack = mqttAck{Status: "error", Error: err.Error()}
+	} else {
+		logger.Info().Bytes("value", payload).Msg("property set from MQTT")
+	}
+
+	b, err := json.Marshal(ack)
+	if err != nil {
+		logger.Err(err).Msg("error encoding MQTT acknowledgement")
+		return
+	}
+	ackTopic := strings.TrimSuffix(topic, "/set") + "/ack"
+	token := m.client.Publish(ackTopic, 1, false, b)
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		logger.Err(token.Error()).Msg("error publishing MQTT acknowledgement")
+	}
+}
+
+func (m *mqttPublisher) setProperty(deviceType, id, property string, payload []byte) error {
+	if !m.writable[property] {
+		return fmt.Errorf("property %s is not writable", property)
+	}
+	set, ok := mqttSetter(deviceType, property)
+	if !ok {
+		return fmt.Errorf("property %s can't be set on %s devices", property, deviceType)
+	}
+
+	// Values may be sent as plain strings, such as heat rather than "heat".
+	value := json.RawMessage(payload)
+	if !json.Valid(payload) {
+		b, err := json.Marshal(string(payload))
+		if err != nil {
+			return err
+		}
+		value = b
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttLockTimeout+10*time.Second)
+	defer cancel()
+	return set(ctx, m.starlingClient, id, value)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog/log"
+)
+
+// runOnce polls every device once and collects their metrics, then pushes
+// them to the Pushgateway at pushURL and/or writes them to textfile, for
+// running the exporter from a timer rather than as a long-lived service.
+func runOnce(ctx context.Context, p *poller, c *Collector, pushURL, job, textfile string) error {
+	if pushURL == "" && textfile == "" {
+		return errors.New("--once needs --push.gateway or --textfile")
+	}
+
+	// Poll first so that the event trackers have seen the current state.
+	p.poll(ctx)
+
+	// The Go runtime and process metrics of a short-lived process aren't
+	// useful, so only the exporter's own metrics are collected.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewBuildInfoCollector())
+	reg.MustRegister(c)
+
+	if pushURL != "" {
+		if err := push.New(pushURL, job).Gatherer(reg).PushContext(ctx); err != nil {
+			return fmt.Errorf("error pushing to Pushgateway: %w", err)
+		}
+		log.Info().Str("url", pushURL).Str("job", job).Msg("pushed metrics")
+	}
+	if textfile != "" {
+		// WriteToTextfile writes to a temporary file and renames it into
+		// place, so the textfile collector never reads a partial file.
+		if err := prometheus.WriteToTextfile(textfile, reg); err != nil {
+			return fmt.Errorf("error writing textfile: %w", err)
+		}
+		log.Info().Str("path", textfile).Msg("wrote metrics")
+	}
+	return nil
+}
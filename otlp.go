@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+// otlpExporter sends the exporter's metrics to an OpenTelemetry collector
+// with OTLP/HTTP after each poll, encoded as JSON.
+//
+// Metrics of a device belong to a resource for the device's structure, so
+// that they carry nest.hub and nest.structure resource attributes. Hub-wide
+// metrics, such as nest_up, belong to a resource with only nest.hub.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	hub      string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	// start is the start time of counters.
+	start time.Time
+}
+
+// newOTLPExporter returns an exporter which sends the metrics from gatherer to
+// endpoint. If endpoint has no path, the standard /v1/metrics is used. hub
+// identifies the Home Hub, e.g. the host of its API.
+func newOTLPExporter(endpoint string, headers map[string]string, hub string, gatherer prometheus.Gatherer) (*otlpExporter, error) {
+	u, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return &otlpExporter{
+		endpoint: u.String(),
+		headers:  headers,
+		hub:      hub,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    time.Now(),
+	}, nil
+}
+
+// export gathers the metrics and sends them. It's called by the poller after
+// each poll, with the devices used to find each device's structure.
+func (e *otlpExporter) export(_ hubStatus, devices []deviceSnapshot) {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		log.Warn().Err(err).Msg("error gathering metrics for OTLP")
+	}
+	structures := make(map[string]string, len(devices))
+	for _, device := range devices {
+		structures[device.ID] = device.StructureName
+	}
+
+	body, err := json.Marshal(e.encode(families, structures, time.Now()))
+	if err != nil {
+		log.Err(err).Msg("error encoding OTLP metrics")
+		return
+	}
+	if err := e.send(body); err != nil {
+		log.Err(err).Str("endpoint", e.endpoint).Msg("error sending OTLP metrics")
+	}
+}
+
+func (e *otlpExporter) send(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The types below are the parts of the OTLP ExportMetricsServiceRequest
+// message used here, in its JSON encoding.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// encode converts metric families to an OTLP request. Counters become
+// cumulative sums and gauges and untyped metrics become gauges; other types
+// aren't produced by the exporter's collectors and are left out. Data points
+// with an id label are grouped under the structure of that device.
+func (e *otlpExporter) encode(families []*dto.MetricFamily, structures map[string]string, now time.Time) otlpRequest {
+	// metrics holds the metrics of each structure, in the order they were
+	// gathered. The empty structure is the hub itself.
+	metrics := make(map[string][]otlpMetric)
+	for _, family := range families {
+		byStructure := make(map[string][]otlpDataPoint)
+		var order []string
+		for _, m := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			at := now
+			if m.TimestampMs != nil {
+				at = time.UnixMilli(m.GetTimestampMs())
+			}
+			point := otlpDataPoint{
+				TimeUnixNano: strconv.FormatInt(at.UnixNano(), 10),
+				AsDouble:     value,
+			}
+			if family.GetType() == dto.MetricType_COUNTER {
+				point.StartTimeUnixNano = strconv.FormatInt(e.start.UnixNano(), 10)
+			}
+			var structure string
+			for _, l := range m.GetLabel() {
+				point.Attributes = append(point.Attributes, otlpString(l.GetName(), l.GetValue()))
+				if l.GetName() == "id" {
+					structure = structures[l.GetValue()]
+				}
+			}
+
+			if _, ok := byStructure[structure]; !ok {
+				order = append(order, structure)
+			}
+			byStructure[structure] = append(byStructure[structure], point)
+		}
+
+		for _, structure := range order {
+			metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+			if family.GetType() == dto.MetricType_COUNTER {
+				metric.Sum = &otlpSum{
+					DataPoints:             byStructure[structure],
+					AggregationTemporality: otlpCumulative,
+					IsMonotonic:            true,
+				}
+			} else {
+				metric.Gauge = &otlpGauge{DataPoints: byStructure[structure]}
+			}
+			metrics[structure] = append(metrics[structure], metric)
+		}
+	}
+
+	structureNames := make([]string, 0, len(metrics))
+	for structure := range metrics {
+		structureNames = append(structureNames, structure)
+	}
+	sort.Strings(structureNames)
+
+	var req otlpRequest
+	for _, structure := range structureNames {
+		attributes := []otlpAttribute{
+			otlpString("service.name", "nest_exporter"),
+			otlpString("nest.hub", e.hub),
+		}
+		if structure != "" {
+			attributes = append(attributes, otlpString("nest.structure", structure))
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, otlpResourceMetrics{
+			Resource: otlpResource{Attributes: attributes},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "github.com/jamesog/nest_exporter"},
+				Metrics: metrics[structure],
+			}},
+		})
+	}
+	return req
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/log"
+)
+
+// poller periodically fetches every device in the background, independently
+// of Prometheus scrapes. This catches momentary events which would otherwise
+// fall between two scrapes, and keeps the latest state of each device in
+// store. Changes to devices' properties between polls are published to
+// changes.
+type poller struct {
+	client   starling.Client
+	interval time.Duration
+	store    *deviceStore
+	changes  *changeBroker
+	handlers map[string][]func(properties any, at time.Time)
+	after    []func(status hubStatus, devices []deviceSnapshot)
+}
+
+func newPoller(client starling.Client, interval time.Duration, store *deviceStore, changes *changeBroker) *poller {
+	return &poller{
+		client:   client,
+		interval: interval,
+		store:    store,
+		changes:  changes,
+		handlers: make(map[string][]func(any, time.Time)),
+	}
+}
+
+// handle registers fn to be called with the properties of every device of the
+// given type on each poll. properties is the value returned by the device
+// type's fetch method.
+func (p *poller) handle(deviceType string, fn func(properties any, at time.Time)) {
+	p.handlers[deviceType] = append(p.handlers[deviceType], fn)
+}
+
+// afterPoll registers fn to be called at the end of each poll with the
+// hub's status and the latest snapshot of every device.
+func (p *poller) afterPoll(fn func(status hubStatus, devices []deviceSnapshot)) {
+	p.after = append(p.after, fn)
+}
+
+// run polls until ctx is cancelled.
+func (p *poller) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *poller) poll(ctx context.Context) {
+	status, err := p.client.Status()
+	if err != nil {
+		log.Err(err).Msg("error fetching status")
+	}
+	p.store.setStatus(status, err, time.Now())
+	defer func() {
+		status, devices := p.store.hubStatus(), p.store.list()
+		for _, fn := range p.after {
+			fn(status, devices)
+		}
+	}()
+
+	devices, err := p.client.Devices()
+	if err != nil {
+		log.Err(err).Msg("error getting devices")
+		p.store.recordError(err, time.Now())
+		return
+	}
+
+	ids := make(map[string]bool, len(devices.Devices))
+	for _, device := range devices.Devices {
+		ids[device.ID] = true
+
+		var t deviceType = genericDevice{}
+		if registered, ok := deviceTypes[device.Type]; ok {
+			t = registered
+		}
+		properties, err := t.fetch(ctx, p.client, device.ID)
+		if err != nil {
+			log.Err(err).Str("id", device.ID).Str("type", device.Type).Msg("error polling device")
+			p.store.setError(device, err)
+			continue
+		}
+
+		now := time.Now()
+		if prev, ok := p.store.update(device, properties, now); ok && prev.Properties != nil {
+			p.publishChanges(device, prev.Properties, properties, now)
+		}
+		for _, fn := range p.handlers[device.Type] {
+			fn(properties, now)
+		}
+	}
+	p.store.retain(ids)
+}
+
+func (p *poller) publishChanges(device starling.CommonProperties, old, new any, at time.Time) {
+	changes, err := diffProperties(device, old, new, at)
+	if err != nil {
+		log.Err(err).Str("id", device.ID).Msg("error comparing device properties")
+		return
+	}
+	for _, change := range changes {
+		p.changes.publish(change)
+	}
+}
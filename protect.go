@@ -1,8 +1,12 @@
 package main
 
 import (
+	"sync"
+	"time"
+
 	"github.com/jamesog/nest_exporter/starling"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -52,20 +56,191 @@ var (
 		protectLabels,
 		nil,
 	)
+	protectBatteryStatus = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "battery_status"),
+		"Battery status, as a stateset",
+		append(protectLabels, "state"),
+		nil,
+	)
+	protectCOState = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "carbon_monoxide_state"),
+		"Carbon Monoxide State Detail, as a stateset",
+		append(protectLabels, "state"),
+		nil,
+	)
+	protectSmokeState = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "smoke_state"),
+		"Smoke State Detail, as a stateset",
+		append(protectLabels, "state"),
+		nil,
+	)
+
+	// Metrics derived from background polling.
+	protectAlarmEvents = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "alarm_events_total"),
+		"Number of alarms raised, by kind and level",
+		append(protectLabels, "kind", "level"),
+		nil,
+	)
+	protectLastAlarm = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "last_alarm_timestamp_seconds"),
+		"Time the last alarm of this kind was raised",
+		append(protectLabels, "kind"),
+		nil,
+	)
+	protectLastManualTest = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemProtect, "last_manual_test_timestamp_seconds"),
+		"Time the last manual test was started",
+		protectLabels,
+		nil,
+	)
+)
+
+// Values of the kind and level labels of the alarm metrics.
+var (
+	protectAlarmKinds  = []string{"smoke", "carbon_monoxide"}
+	protectAlarmLevels = []string{"warn", "emergency"}
+)
+
+// Values of the state label of the stateset metrics. Any value Starling
+// returns which isn't listed is reported as "unknown".
+var (
+	protectBatteryStates     = []string{"normal", "low", "unknown"}
+	protectStateDetailStates = []string{"ok", "warn", "emergency", "unknown"}
 )
 
-func convertStateDetail(stateDetail string) float64 {
+func init() {
+	registerDeviceType("protect", typedDevice[starling.ProtectProperties](func(c Collector, protect starling.ProtectProperties, ch chan<- prometheus.Metric) {
+		var events *protectEvents
+		if c.protectEvents != nil {
+			e := c.protectEvents.get(protect.ID)
+			events = &e
+		}
+		protectMetrics(protect, events, ch)
+	}))
+}
+
+// convertStateDetail returns the state detail as a percentage. ok is false if
+// the state detail isn't one Starling is known to return.
+func convertStateDetail(stateDetail string) (pct float64, ok bool) {
 	switch stateDetail {
 	case "emergency":
-		return 100
+		return 100, true
 	case "warn":
-		return 50
+		return 50, true
+	case "ok":
+		return 0, true
 	default:
-		return 0
+		return 0, false
+	}
+}
+
+type protectAlarm struct {
+	kind  string
+	level string
+}
+
+// protectEvents holds the alarms and manual tests seen for a single Protect.
+type protectEvents struct {
+	alarms         map[protectAlarm]float64
+	lastAlarm      map[string]time.Time
+	lastManualTest time.Time
+}
+
+// protectEventTracker detects alarms and manual tests on Protects from the
+// background poller, so that alarms which clear between two scrapes are still
+// recorded.
+type protectEventTracker struct {
+	mu     sync.Mutex
+	last   map[string]starling.ProtectProperties
+	events map[string]*protectEvents
+}
+
+func newProtectEventTracker() *protectEventTracker {
+	return &protectEventTracker{
+		last:   make(map[string]starling.ProtectProperties),
+		events: make(map[string]*protectEvents),
 	}
 }
 
-func protectMetrics(protect starling.ProtectProperties, ch chan<- prometheus.Metric) {
+// observe compares the Protect's state to the previous poll. An alarm is
+// recorded each time the smoke or CO state detail escalates, e.g. from ok to
+// warn or from warn to emergency. State which is already active the first time
+// a Protect is seen is not recorded.
+func (t *protectEventTracker) observe(protect starling.ProtectProperties, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events, ok := t.events[protect.ID]
+	if !ok {
+		events = &protectEvents{
+			alarms:    make(map[protectAlarm]float64),
+			lastAlarm: make(map[string]time.Time),
+		}
+		t.events[protect.ID] = events
+	}
+
+	last, seen := t.last[protect.ID]
+	t.last[protect.ID] = protect
+	if !seen {
+		return
+	}
+
+	details := map[string][2]string{
+		"smoke":           {last.SmokeStateDetail, protect.SmokeStateDetail},
+		"carbon_monoxide": {last.COStateDetail, protect.COStateDetail},
+	}
+	for kind, detail := range details {
+		prev, _ := convertStateDetail(detail[0])
+		cur, ok := convertStateDetail(detail[1])
+		if !ok || cur <= prev {
+			continue
+		}
+		events.alarms[protectAlarm{kind, detail[1]}]++
+		events.lastAlarm[kind] = now
+		log.Warn().
+			Str("id", protect.ID).
+			Str("name", protect.Name).
+			Str("where", protect.Where).
+			Str("kind", kind).
+			Str("alarm_level", detail[1]).
+			Msg("Protect alarm raised")
+	}
+
+	if protect.ManualTestActive && !last.ManualTestActive {
+		events.lastManualTest = now
+		log.Info().
+			Str("id", protect.ID).
+			Str("name", protect.Name).
+			Str("where", protect.Where).
+			Msg("Protect manual test started")
+	}
+}
+
+// get returns a copy of the events recorded for the Protect.
+func (t *protectEventTracker) get(id string) protectEvents {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := protectEvents{
+		alarms:    make(map[protectAlarm]float64),
+		lastAlarm: make(map[string]time.Time),
+	}
+	if e, ok := t.events[id]; ok {
+		for k, v := range e.alarms {
+			events.alarms[k] = v
+		}
+		for k, v := range e.lastAlarm {
+			events.lastAlarm[k] = v
+		}
+		events.lastManualTest = e.lastManualTest
+	}
+	return events
+}
+
+// protectMetrics sends the Protect's metrics to ch. The event metrics are left
+// out if events is nil.
+func protectMetrics(protect starling.ProtectProperties, events *protectEvents, ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(
 		protectCODetected,
 		prometheus.GaugeValue,
@@ -98,16 +273,62 @@ func protectMetrics(protect starling.ProtectProperties, ch chan<- prometheus.Met
 		boolToFloat64(protect.BatteryStatus == "low"),
 		protect.ID, protect.Name, protect.Where,
 	)
-	ch <- prometheus.MustNewConstMetric(
-		protectCOStateDetail,
-		prometheus.GaugeValue,
-		convertStateDetail(protect.COStateDetail),
-		protect.ID, protect.Name, protect.Where,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		protectSmokeStateDetail,
-		prometheus.GaugeValue,
-		convertStateDetail(protect.SmokeStateDetail),
-		protect.ID, protect.Name, protect.Where,
-	)
+	// The percentages are omitted for unknown states rather than reported as
+	// 0, which would be indistinguishable from ok.
+	if pct, ok := convertStateDetail(protect.COStateDetail); ok {
+		ch <- prometheus.MustNewConstMetric(
+			protectCOStateDetail,
+			prometheus.GaugeValue,
+			pct,
+			protect.ID, protect.Name, protect.Where,
+		)
+	} else {
+		log.Debug().Str("id", protect.ID).Str("coStateDetail", protect.COStateDetail).Msg("unknown state detail")
+	}
+	if pct, ok := convertStateDetail(protect.SmokeStateDetail); ok {
+		ch <- prometheus.MustNewConstMetric(
+			protectSmokeStateDetail,
+			prometheus.GaugeValue,
+			pct,
+			protect.ID, protect.Name, protect.Where,
+		)
+	} else {
+		log.Debug().Str("id", protect.ID).Str("smokeStateDetail", protect.SmokeStateDetail).Msg("unknown state detail")
+	}
+
+	// Statesets
+	stateSetMetrics(protectBatteryStatus, protectBatteryStates, protect.BatteryStatus, ch, protect.ID, protect.Name, protect.Where)
+	stateSetMetrics(protectCOState, protectStateDetailStates, protect.COStateDetail, ch, protect.ID, protect.Name, protect.Where)
+	stateSetMetrics(protectSmokeState, protectStateDetailStates, protect.SmokeStateDetail, ch, protect.ID, protect.Name, protect.Where)
+
+	// Events from background polling
+	if events == nil {
+		return
+	}
+	for _, kind := range protectAlarmKinds {
+		for _, level := range protectAlarmLevels {
+			ch <- prometheus.MustNewConstMetric(
+				protectAlarmEvents,
+				prometheus.CounterValue,
+				events.alarms[protectAlarm{kind, level}],
+				protect.ID, protect.Name, protect.Where, kind, level,
+			)
+		}
+		if t, ok := events.lastAlarm[kind]; ok {
+			ch <- prometheus.MustNewConstMetric(
+				protectLastAlarm,
+				prometheus.GaugeValue,
+				float64(t.Unix()),
+				protect.ID, protect.Name, protect.Where, kind,
+			)
+		}
+	}
+	if !events.lastManualTest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			protectLastManualTest,
+			prometheus.GaugeValue,
+			float64(events.lastManualTest.Unix()),
+			protect.ID, protect.Name, protect.Where,
+		)
+	}
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+)
+
+func TestProtectEventTracker(t *testing.T) {
+	protect := func(smoke, co string, manualTest bool) starling.ProtectProperties {
+		return starling.ProtectProperties{
+			CommonProperties: starling.CommonProperties{ID: "p1"},
+			SmokeStateDetail: smoke,
+			COStateDetail:    co,
+			ManualTestActive: manualTest,
+		}
+	}
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name           string
+		polls          []starling.ProtectProperties
+		wantAlarms     map[protectAlarm]float64
+		wantLastAlarm  map[string]time.Time
+		wantManualTest time.Time
+	}{
+		{
+			name:          "alarming on first sight",
+			polls:         []starling.ProtectProperties{protect("emergency", "warn", true)},
+			wantAlarms:    map[protectAlarm]float64{},
+			wantLastAlarm: map[string]time.Time{},
+		},
+		{
+			name:          "still alarming",
+			polls:         []starling.ProtectProperties{protect("warn", "ok", false), protect("warn", "ok", false)},
+			wantAlarms:    map[protectAlarm]float64{},
+			wantLastAlarm: map[string]time.Time{},
+		},
+		{
+			name:  "rising edge",
+			polls: []starling.ProtectProperties{protect("ok", "ok", false), protect("ok", "warn", false), protect("ok", "warn", false)},
+			wantAlarms: map[protectAlarm]float64{
+				{"carbon_monoxide", "warn"}: 1,
+			},
+			wantLastAlarm: map[string]time.Time{"carbon_monoxide": start.Add(time.Minute)},
+		},
+		{
+			name: "escalation",
+			polls: []starling.ProtectProperties{
+				protect("ok", "ok", false),
+				protect("warn", "ok", false),
+				protect("emergency", "ok", false),
+			},
+			wantAlarms: map[protectAlarm]float64{
+				{"smoke", "warn"}:      1,
+				{"smoke", "emergency"}: 1,
+			},
+			wantLastAlarm: map[string]time.Time{"smoke": start.Add(2 * time.Minute)},
+		},
+		{
+			name: "de-escalation",
+			polls: []starling.ProtectProperties{
+				protect("ok", "ok", false),
+				protect("emergency", "ok", false),
+				protect("warn", "ok", false),
+				protect("ok", "ok", false),
+			},
+			wantAlarms: map[protectAlarm]float64{
+				{"smoke", "emergency"}: 1,
+			},
+			wantLastAlarm: map[string]time.Time{"smoke": start.Add(time.Minute)},
+		},
+		{
+			name: "unknown state",
+			polls: []starling.ProtectProperties{
+				protect("ok", "ok", false),
+				protect("", "ok", false),
+				protect("ok", "ok", false),
+			},
+			wantAlarms:    map[protectAlarm]float64{},
+			wantLastAlarm: map[string]time.Time{},
+		},
+		{
+			name: "manual test",
+			polls: []starling.ProtectProperties{
+				protect("ok", "ok", false),
+				protect("ok", "ok", true),
+				protect("ok", "ok", true),
+			},
+			wantAlarms:     map[protectAlarm]float64{},
+			wantLastAlarm:  map[string]time.Time{},
+			wantManualTest: start.Add(time.Minute),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newProtectEventTracker()
+			for i, protect := range tt.polls {
+				tracker.observe(protect, start.Add(time.Duration(i)*time.Minute))
+			}
+			got := tracker.get("p1")
+			if !reflect.DeepEqual(got.alarms, tt.wantAlarms) {
+				t.Errorf("got alarms %v, want %v", got.alarms, tt.wantAlarms)
+			}
+			if !reflect.DeepEqual(got.lastAlarm, tt.wantLastAlarm) {
+				t.Errorf("got last alarms %v, want %v", got.lastAlarm, tt.wantLastAlarm)
+			}
+			if !got.lastManualTest.Equal(tt.wantManualTest) {
+				t.Errorf("got last manual test %v, want %v", got.lastManualTest, tt.wantManualTest)
+			}
+		})
+	}
+}
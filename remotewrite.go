@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = time.Minute
+)
+
+var remoteWriteDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "remote_write",
+		Name:      "dropped_requests_total",
+		Help:      "Number of remote-write requests dropped because the queue was full or the endpoint rejected them",
+	},
+)
+
+// remoteWriter pushes the metrics from gatherer to a Prometheus remote-write
+// endpoint after each poll, for sites which can't be scraped.
+//
+// Requests are queued, and sent in order by run. If the endpoint can't be
+// reached, or fails with a server error, the request at the front of the queue
+// is retried with exponential backoff. Once the queue is full, the oldest
+// requests are dropped.
+type remoteWriter struct {
+	url      string
+	username string
+	password string
+	token    string
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	maxQueue int
+
+	mu     sync.Mutex
+	queue  []remoteWriteRequest
+	seq    uint64
+	notify chan struct{}
+}
+
+// remoteWriteRequest is a queued, compressed WriteRequest.
+type remoteWriteRequest struct {
+	seq  uint64
+	body []byte
+}
+
+type remoteWriteConfig struct {
+	URL       string
+	Username  string
+	Password  string
+	Token     string
+	QueueSize int
+}
+
+func newRemoteWriter(cfg remoteWriteConfig, gatherer prometheus.Gatherer) (*remoteWriter, error) {
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid remote-write URL: %w", err)
+	}
+	if cfg.QueueSize < 1 {
+		return nil, fmt.Errorf("remote-write queue size must be at least 1")
+	}
+	return &remoteWriter{
+		url:      cfg.URL,
+		username: cfg.Username,
+		password: cfg.Password,
+		token:    cfg.Token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		gatherer: gatherer,
+		maxQueue: cfg.QueueSize,
+		notify:   make(chan struct{}, 1),
+	}, nil
+}
+
+// queueLength returns the number of requests waiting to be sent.
+func (w *remoteWriter) queueLength() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return float64(len(w.queue))
+}
+
+// enqueue gathers the current value of every metric and queues them to be
+// sent. It's called by the poller after each poll.
+func (w *remoteWriter) enqueue(hubStatus, []deviceSnapshot) {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		// Gather returns as many metrics as it can alongside the error.
+		log.Warn().Err(err).Msg("error gathering metrics for remote-write")
+	}
+	req := encodeWriteRequest(families, time.Now())
+	if req == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if len(w.queue) >= w.maxQueue {
+		w.queue = w.queue[1:]
+		remoteWriteDropped.Inc()
+		log.Warn().Msg("remote-write queue full; dropped oldest request")
+	}
+	w.seq++
+	w.queue = append(w.queue, remoteWriteRequest{seq: w.seq, body: snappy.Encode(nil, req)})
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run sends queued requests until ctx is cancelled.
+func (w *remoteWriter) run(ctx context.Context) {
+	backoff := remoteWriteMinBackoff
+	for {
+		w.mu.Lock()
+		var next remoteWriteRequest
+		if len(w.queue) > 0 {
+			next = w.queue[0]
+		}
+		w.mu.Unlock()
+
+		if next.body == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.notify:
+			}
+			continue
+		}
+
+		retry, err := w.send(ctx, next.body)
+		if err != nil && retry {
+			log.Warn().Err(err).Dur("retry_in", backoff).Msg("error sending remote-write request")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > remoteWriteMaxBackoff {
+				backoff = remoteWriteMaxBackoff
+			}
+			continue
+		}
+		if err != nil {
+			log.Err(err).Msg("remote-write request rejected; dropping it")
+			remoteWriteDropped.Inc()
+		}
+		backoff = remoteWriteMinBackoff
+
+		w.mu.Lock()
+		// The front of the queue may have been dropped while sending.
+		if len(w.queue) > 0 && w.queue[0].seq == next.seq {
+			w.queue = w.queue[1:]
+		}
+		w.mu.Unlock()
+	}
+}
+
+// send posts a request, reporting whether it should be retried if it fails.
+// Client errors other than 429 Too Many Requests won't succeed if retried.
+func (w *remoteWriter) send(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case w.token != "":
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	case w.username != "":
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// remoteWriteLabel is a label of a remote-write time series.
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// encodeWriteRequest encodes metric families as a remote-write WriteRequest
+// protobuf message. Samples without their own timestamp are given now. It
+// returns nil if there are no samples.
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	var b []byte
+	series := func(name string, m *dto.Metric, value float64, extra ...remoteWriteLabel) {
+		labels := append([]remoteWriteLabel{{"__name__", name}}, extra...)
+		for _, l := range m.GetLabel() {
+			labels = append(labels, remoteWriteLabel{l.GetName(), l.GetValue()})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		ts := now.UnixMilli()
+		if m.TimestampMs != nil {
+			ts = m.GetTimestampMs()
+		}
+
+		// TimeSeries: repeated Label labels = 1; repeated Sample samples = 2;
+		var s []byte
+		for _, l := range labels {
+			// Label: string name = 1; string value = 2;
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			s = protowire.AppendTag(s, 1, protowire.BytesType)
+			s = protowire.AppendBytes(s, lb)
+		}
+		// Sample: double value = 1; int64 timestamp = 2;
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(ts))
+		s = protowire.AppendTag(s, 2, protowire.BytesType)
+		s = protowire.AppendBytes(s, sb)
+
+		// WriteRequest: repeated TimeSeries timeseries = 1;
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				series(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					series(name, m, q.GetValue(), remoteWriteLabel{"quantile", fmt.Sprint(q.GetQuantile())})
+				}
+				series(name+"_sum", m, summary.GetSampleSum())
+				series(name+"_count", m, float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					series(name+"_bucket", m, float64(bucket.GetCumulativeCount()), remoteWriteLabel{"le", fmt.Sprint(bucket.GetUpperBound())})
+				}
+				series(name+"_bucket", m, float64(histogram.GetSampleCount()), remoteWriteLabel{"le", "+Inf"})
+				series(name+"_sum", m, histogram.GetSampleSum())
+				series(name+"_count", m, float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+type decodedSeries struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes a WriteRequest with one sample per series, as
+// encodeWriteRequest produces.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	t.Helper()
+
+	// fields calls fn with the number and value of each field of a message.
+	fields := func(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			fn(num, typ, b[:n])
+			b = b[n:]
+		}
+	}
+	bytesField := func(typ protowire.Type, v []byte) []byte {
+		if typ != protowire.BytesType {
+			t.Fatalf("got wire type %d, want bytes", typ)
+		}
+		b, _ := protowire.ConsumeBytes(v)
+		return b
+	}
+
+	var series []decodedSeries
+	fields(b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num != 1 {
+			t.Fatalf("unexpected WriteRequest field %d", num)
+		}
+		var s decodedSeries
+		samples := 0
+		fields(bytesField(typ, v), func(num protowire.Number, typ protowire.Type, v []byte) {
+			switch num {
+			case 1:
+				var l remoteWriteLabel
+				fields(bytesField(typ, v), func(num protowire.Number, typ protowire.Type, v []byte) {
+					switch num {
+					case 1:
+						l.name = string(bytesField(typ, v))
+					case 2:
+						l.value = string(bytesField(typ, v))
+					default:
+						t.Fatalf("unexpected Label field %d", num)
+					}
+				})
+				s.labels = append(s.labels, l)
+			case 2:
+				samples++
+				fields(bytesField(typ, v), func(num protowire.Number, typ protowire.Type, v []byte) {
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						bits, _ := protowire.ConsumeFixed64(v)
+						s.value = math.Float64frombits(bits)
+					case num == 2 && typ == protowire.VarintType:
+						ts, _ := protowire.ConsumeVarint(v)
+						s.timestamp = int64(ts)
+					default:
+						t.Fatalf("unexpected Sample field %d of type %d", num, typ)
+					}
+				})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", num)
+			}
+		})
+		if samples != 1 {
+			t.Fatalf("got %d samples in a series, want 1", samples)
+		}
+		series = append(series, s)
+	})
+	return series
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	families := []*dto.MetricFamily{
+		{
+			Name: ptr("nest_thermostat_current_temperature_celsius"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: ptr("where"), Value: ptr("Hall")},
+					{Name: ptr("id"), Value: ptr("t1")},
+					{Name: ptr("name"), Value: ptr("Living room")},
+				},
+				Gauge: &dto.Gauge{Value: ptr(20.5)},
+			}},
+		},
+		{
+			Name: ptr("nest_thermostat_heating_seconds_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: ptr("id"), Value: ptr("t1")}},
+				Counter:     &dto.Counter{Value: ptr(3600.0)},
+				TimestampMs: ptr(int64(1690000000000)),
+			}},
+		},
+		{
+			Name: ptr("nest_request_duration_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{
+				Summary: &dto.Summary{
+					SampleCount: ptr(uint64(4)),
+					SampleSum:   ptr(2.0),
+					Quantile:    []*dto.Quantile{{Quantile: ptr(0.5), Value: ptr(0.25)}},
+				},
+			}},
+		},
+	}
+
+	got := decodeWriteRequest(t, encodeWriteRequest(families, now))
+	want := []decodedSeries{
+		{
+			labels: []remoteWriteLabel{
+				{"__name__", "nest_thermostat_current_temperature_celsius"},
+				{"id", "t1"},
+				{"name", "Living room"},
+				{"where", "Hall"},
+			},
+			value:     20.5,
+			timestamp: now.UnixMilli(),
+		},
+		{
+			labels: []remoteWriteLabel{
+				{"__name__", "nest_thermostat_heating_seconds_total"},
+				{"id", "t1"},
+			},
+			value:     3600,
+			timestamp: 1690000000000,
+		},
+		{
+			labels: []remoteWriteLabel{
+				{"__name__", "nest_request_duration_seconds"},
+				{"quantile", "0.5"},
+			},
+			value:     0.25,
+			timestamp: now.UnixMilli(),
+		},
+		{
+			labels:    []remoteWriteLabel{{"__name__", "nest_request_duration_seconds_sum"}},
+			value:     2,
+			timestamp: now.UnixMilli(),
+		},
+		{
+			labels:    []remoteWriteLabel{{"__name__", "nest_request_duration_seconds_count"}},
+			value:     4,
+			timestamp: now.UnixMilli(),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encodeWriteRequest decoded to\n%+v\nwant\n%+v", got, want)
+	}
+	for _, s := range got {
+		if !sort.SliceIsSorted(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name }) {
+			t.Errorf("labels aren't sorted: %+v", s.labels)
+		}
+	}
+}
+
+func TestEncodeWriteRequestEmpty(t *testing.T) {
+	if b := encodeWriteRequest(nil, time.Now()); b != nil {
+		t.Errorf("encodeWriteRequest(nil) = %x, want nil", b)
+	}
+}
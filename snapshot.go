@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/rs/zerolog/hlog"
+)
+
+type snapshotKey struct {
+	id    string
+	width int
+}
+
+type cachedSnapshot struct {
+	starling.Snapshot
+	fetchedAt time.Time
+}
+
+// snapshotFetch is a fetch of a snapshot in progress, which requests for the
+// same snapshot wait for rather than fetching it again.
+type snapshotFetch struct {
+	done chan struct{}
+	snap cachedSnapshot
+	err  error
+}
+
+// snapshotFetchTimeout is how long a fetch of a snapshot can take. It isn't
+// tied to any one request, as several may be waiting for it.
+const snapshotFetchTimeout = 30 * time.Second
+
+// snapshotProxy serves camera snapshots from Starling, caching each one for a
+// short time so that dashboards refreshing often don't overload the Home Hub.
+// Only cameras found by the poller are served.
+type snapshotProxy struct {
+	client starling.Client
+	store  *deviceStore
+	// token is the bearer token required to fetch snapshots.
+	token string
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	cache    map[snapshotKey]cachedSnapshot
+	fetching map[snapshotKey]*snapshotFetch
+}
+
+func newSnapshotProxy(client starling.Client, store *deviceStore, token string, ttl time.Duration) *snapshotProxy {
+	return &snapshotProxy{
+		client:   client,
+		store:    store,
+		token:    token,
+		ttl:      ttl,
+		cache:    make(map[snapshotKey]cachedSnapshot),
+		fetching: make(map[snapshotKey]*snapshotFetch),
+	}
+}
+
+// ServeHTTP handles /camera/{id}/snapshot.jpg. The optional width query
+// parameter is passed to Starling to scale the image.
+func (p *snapshotProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/camera/"), "/snapshot.jpg")
+	if id == "" || strings.Contains(id, "/") || !strings.HasSuffix(r.URL.Path, "/snapshot.jpg") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, p.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if device, ok := p.store.get(id); !ok || device.Type != "cam" {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := snapshotKey{id: id}
+	if width := r.URL.Query().Get("width"); width != "" {
+		n, err := strconv.Atoi(width)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid width", http.StatusBadRequest)
+			return
+		}
+		key.width = n
+	}
+
+	// The permissions are checked by the poller, so there's no need to
+	// fetch the hub's status for each snapshot.
+	if status := p.store.hubStatus(); status.Status == nil || !status.Permissions.Camera {
+		http.Error(w, starling.ErrCameraNotPermitted.Error(), http.StatusForbidden)
+		return
+	}
+
+	snap, err := p.get(key)
+	switch {
+	case errors.Is(err, starling.ErrCameraNotPermitted):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		hlog.FromRequest(r).Err(err).Str("id", id).Msg("error fetching camera snapshot")
+		http.Error(w, "error fetching snapshot", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", snap.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(snap.Image)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(p.ttl.Seconds())))
+	w.Header().Set("Last-Modified", snap.fetchedAt.UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodGet {
+		w.Write(snap.Image)
+	}
+}
+
+// get returns the cached snapshot for key if it's recent enough, or fetches a
+// new one. Concurrent requests for the same snapshot share a single fetch.
+func (p *snapshotProxy) get(key snapshotKey) (cachedSnapshot, error) {
+	p.mu.Lock()
+	if snap, ok := p.cache[key]; ok && time.Since(snap.fetchedAt) < p.ttl {
+		p.mu.Unlock()
+		return snap, nil
+	}
+	f, ok := p.fetching[key]
+	if !ok {
+		f = &snapshotFetch{done: make(chan struct{})}
+		p.fetching[key] = f
+		go p.fetch(key, f)
+	}
+	p.mu.Unlock()
+
+	<-f.done
+	return f.snap, f.err
+}
+
+// fetch fetches the snapshot for key, caching it if it's fetched.
+func (p *snapshotProxy) fetch(key snapshotKey, f *snapshotFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotFetchTimeout)
+	defer cancel()
+
+	s, err := p.client.CameraSnapshot(ctx, key.id, key.width)
+	if err == nil {
+		if s.ContentType == "" {
+			s.ContentType = "image/jpeg"
+		}
+		f.snap = cachedSnapshot{Snapshot: *s, fetchedAt: time.Now()}
+	}
+	f.err = err
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.fetching, key)
+	close(f.done)
+	if err != nil {
+		return
+	}
+	// Drop anything expired so that the cache doesn't grow with every width
+	// ever requested.
+	for k, v := range p.cache {
+		if time.Since(v.fetchedAt) >= p.ttl {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = f.snap
+}
@@ -0,0 +1,52 @@
+package starling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ErrCameraNotPermitted is the error for an API key which hasn't been granted
+// camera permission on the Home Hub.
+var ErrCameraNotPermitted = errors.New("API key does not have camera permission")
+
+// Snapshot is an image from a camera.
+type Snapshot struct {
+	Image       []byte
+	ContentType string
+}
+
+// CameraSnapshot fetches the latest image from the camera with the given ID.
+// If width is greater than 0, Starling scales the image to that width.
+//
+// The API key needs camera permission. This isn't checked here, to save a
+// request for each snapshot; check Status().Permissions.Camera first and
+// return ErrCameraNotPermitted if it's not granted.
+func (c Client) CameraSnapshot(ctx context.Context, id string, width int) (*Snapshot, error) {
+	query := url.Values{}
+	if width > 0 {
+		query.Set("width", strconv.Itoa(width))
+	}
+	resp, err := c.doRequest(ctx, "GET", "/devices/"+url.PathEscape(id)+"/snapshot", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(body, fmt.Errorf("unexpected status %s", resp.Status))
+	}
+
+	return &Snapshot{
+		Image:       body,
+		ContentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
@@ -23,11 +23,16 @@ type ThermostatProperties struct {
 	CanHeat                           bool    `json:"canHeat"`
 	CanCool                           bool    `json:"canCool"`
 	EcoMode                           bool    `json:"ecoMode"`
+	FanRunning                        bool    `json:"fanRunning"`
+	FanTimerActive                    bool    `json:"fanTimerActive"`
+	FanTimerDuration                  float64 `json:"fanTimerDuration"`
+	TargetHumidity                    float64 `json:"targetHumidity"`
 }
 
 type TemperatureSensorProperties struct {
-	BatteryStatus      string `json:"batteryStatus"`
-	CurrentTemperature int    `json:"currentTemperature"`
+	CommonProperties
+	BatteryStatus      string  `json:"batteryStatus"`
+	CurrentTemperature float64 `json:"currentTemperature"`
 }
 
 type ProtectProperties struct {
@@ -42,6 +47,7 @@ type ProtectProperties struct {
 }
 
 type CameraProperties struct {
+	CommonProperties
 	AnimalDetected    bool   `json:"animalDetected"`
 	BatteryIsCharging bool   `json:"batteryIsCharging"`
 	BatteryLevel      int    `json:"batteryLevel"`
@@ -63,12 +69,14 @@ type CameraProperties struct {
 }
 
 type GuardProperties struct {
+	CommonProperties
 	BatteryStatus string `json:"batteryStatus"`
 	CurrentState  string `json:"currentState"`
 	TargetState   string `json:"targetState"`
 }
 
 type DetectProperties struct {
+	CommonProperties
 	BatteryStatus string `json:"batteryStatus"`
 	ButtonPushed  bool   `json:"buttonPushed"`
 	ContactState  string `json:"contactState"`
@@ -77,6 +85,7 @@ type DetectProperties struct {
 }
 
 type YaleLockProperties struct {
+	CommonProperties
 	AutoRelockEnabled   bool   `json:"autoRelockEnabled"`
 	BatteryStatus       string `json:"batteryStatus"`
 	CurrentState        string `json:"currentState"`
@@ -87,12 +96,12 @@ type YaleLockProperties struct {
 }
 
 type HomeAwayControlProperties struct {
+	CommonProperties
 	HomeState string `json:"homeState"`
 }
 
 type WeatherServiceProperties struct {
-	CurrentTemperature int    `json:"currentTemperature"`
-	HumidityPercent    int    `json:"humidityPercent"`
-	SerialNumber       string `json:"serialNumber"`
-	StructureName      string `json:"structureName"`
+	CommonProperties
+	CurrentTemperature float64 `json:"currentTemperature"`
+	HumidityPercent    float64 `json:"humidityPercent"`
 }
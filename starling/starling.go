@@ -2,6 +2,7 @@ package starling
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -38,8 +39,33 @@ var (
 	errUnauthorized = errors.New("unauthorized")
 )
 
-func (c Client) makeRequest(method, endpoint string, payload []byte) ([]byte, error) {
+func (c Client) makeRequest(ctx context.Context, method, endpoint string, payload []byte) ([]byte, error) {
+	resp, err := c.doRequest(ctx, method, endpoint, nil, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	defer func() { err = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	// We return the body for 400 and 401 to parse the JSON response from the Starling API.
+	case http.StatusBadRequest:
+		return body, errBadRequest
+	case http.StatusUnauthorized:
+		return body, errUnauthorized
+	default:
+		return body, err
+	}
+}
+
+// doRequest sends a request to the endpoint, adding the API key to query.
+// The caller must close the response body.
+func (c Client) doRequest(ctx context.Context, method, endpoint string, query url.Values, payload []byte) (*http.Response, error) {
 	qs := url.Values{}
+	for k, v := range query {
+		qs[k] = v
+	}
 	qs.Set("key", c.APIKey)
 	client := http.Client{
 		Timeout: 5 * time.Second,
@@ -51,29 +77,25 @@ func (c Client) makeRequest(method, endpoint string, payload []byte) ([]byte, er
 	ep.Path += endpoint
 	ep.RawQuery = qs.Encode()
 
-	req, err := http.NewRequest(method, ep.String(), bytes.NewReader(payload))
+	req, err := http.NewRequestWithContext(ctx, method, ep.String(), bytes.NewReader(payload))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("User-Agent", c.userAgent)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	defer func() { err = resp.Body.Close() }()
-
-	switch resp.StatusCode {
-	// We return the body for 400 and 401 to parse the JSON response from the Starling API.
-	case http.StatusBadRequest:
-		return body, errBadRequest
-	case http.StatusUnauthorized:
-		return body, errUnauthorized
-	default:
-		return body, err
+	resp, err := client.Do(req)
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		// The API key is in the URL, so keep it out of errors which may
+		// be logged or shown to users.
+		qs.Set("key", "REDACTED")
+		ep.RawQuery = qs.Encode()
+		uerr.URL = ep.String()
 	}
+	return resp, err
 }
 
 type Status struct {
@@ -89,7 +111,11 @@ type Status struct {
 }
 
 func (c Client) Status() (*Status, error) {
-	resp, err := c.makeRequest("GET", "/status", nil)
+	return c.status(context.Background())
+}
+
+func (c Client) status(ctx context.Context) (*Status, error) {
+	resp, err := c.makeRequest(ctx, "GET", "/status", nil)
 	if err != nil {
 		if (errors.Is(err, errUnauthorized) || errors.Is(err, errBadRequest)) && resp != nil {
 			status := Error{}
@@ -121,7 +147,7 @@ type Devices struct {
 }
 
 func (c Client) Devices() (*Devices, error) {
-	resp, err := c.makeRequest("GET", "/devices", nil)
+	resp, err := c.makeRequest(context.Background(), "GET", "/devices", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -140,48 +166,85 @@ type Device struct {
 	} `json:"properties"`
 }
 
-func (c Client) deviceProperties(id string) ([]byte, error) {
-	return c.makeRequest("GET", "/devices/"+id, nil)
+// DeviceResponse is the envelope Starling returns device properties in.
+type DeviceResponse[T any] struct {
+	Status     string `json:"status"`
+	Properties T      `json:"properties"`
 }
 
-type ThermostatResponse struct {
-	Status     string               `json:"status"`
-	Properties ThermostatProperties `json:"properties"`
-}
+// Deprecated: use DeviceResponse[ThermostatProperties].
+type ThermostatResponse = DeviceResponse[ThermostatProperties]
 
-func (c Client) ThermostatProperties(id string) (*ThermostatProperties, error) {
-	resp, err := c.deviceProperties(id)
+// Deprecated: use DeviceResponse[ProtectProperties].
+type ProtectResponse = DeviceResponse[ProtectProperties]
+
+// DeviceProperties fetches the properties of the device with the given ID,
+// decoding them into T.
+func DeviceProperties[T any](ctx context.Context, c Client, id string) (*T, error) {
+	resp, err := c.makeRequest(ctx, "GET", "/devices/"+url.PathEscape(id), nil)
 	if err != nil {
-		return nil, err
+		return nil, responseError(resp, err)
 	}
 
-	device := ThermostatResponse{}
-	err = json.Unmarshal(resp, &device)
-	if err != nil {
+	device := DeviceResponse[T]{}
+	if err := decodeResponse(resp, &device); err != nil {
 		return nil, err
 	}
 
 	return &device.Properties, nil
 }
 
-type ProtectResponse struct {
-	Status     string            `json:"status"`
-	Properties ProtectProperties `json:"properties"`
+// DeviceProperty fetches a single property of the device with the given ID,
+// decoding it into T.
+func DeviceProperty[T any](ctx context.Context, c Client, id, property string) (T, error) {
+	var value T
+	resp, err := c.makeRequest(ctx, "GET", "/devices/"+url.PathEscape(id)+"/"+url.PathEscape(property), nil)
+	if err != nil {
+		return value, responseError(resp, err)
+	}
+
+	device := DeviceResponse[map[string]json.RawMessage]{}
+	if err := decodeResponse(resp, &device); err != nil {
+		return value, err
+	}
+	raw, ok := device.Properties[property]
+	if !ok {
+		return value, fmt.Errorf("property %s missing from response", property)
+	}
+	err = json.Unmarshal(raw, &value)
+	return value, err
+}
+
+func (c Client) ThermostatProperties(id string) (*ThermostatProperties, error) {
+	return DeviceProperties[ThermostatProperties](context.Background(), c, id)
 }
 
 func (c Client) ProtectProperties(id string) (*ProtectProperties, error) {
-	resp, err := c.deviceProperties(id)
-	if err != nil {
-		return nil, err
-	}
+	return DeviceProperties[ProtectProperties](context.Background(), c, id)
+}
 
-	device := ProtectResponse{}
-	err = json.Unmarshal(resp, &device)
-	if err != nil {
-		return nil, err
+// decodeResponse checks the status in Starling's response envelope before
+// unmarshalling resp into v. If the status isn't OK, the error in the response
+// is returned.
+func decodeResponse(resp []byte, v any) error {
+	status := Error{}
+	if err := json.Unmarshal(resp, &status); err != nil {
+		return err
 	}
+	if !strings.EqualFold(status.Status, "OK") {
+		return status
+	}
+	return json.Unmarshal(resp, v)
+}
 
-	return &device.Properties, nil
+// responseError returns the error Starling gave in resp, if there is one,
+// wrapping err.
+func responseError(resp []byte, err error) error {
+	status := Error{}
+	if resp == nil || json.Unmarshal(resp, &status) != nil || status.Message == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, status.Message)
 }
 
 type Error struct {
@@ -189,3 +252,14 @@ type Error struct {
 	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 }
+
+func (e Error) Error() string {
+	switch {
+	case e.Message != "":
+		return e.Message
+	case e.Code != "":
+		return e.Code
+	default:
+		return fmt.Sprintf("unexpected status %q", e.Status)
+	}
+}
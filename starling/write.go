@@ -0,0 +1,305 @@
+package starling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrWriteNotPermitted is returned by setters when the API key hasn't
+	// been granted write permission on the Home Hub.
+	ErrWriteNotPermitted = errors.New("API key does not have write permission")
+	// ErrNotSupported is returned by setters when the device doesn't support
+	// the change, such as setting a thermostat which can't cool to cool mode.
+	ErrNotSupported = errors.New("not supported by device")
+	// ErrInvalidValue is returned by setters when the value isn't valid for
+	// the property, such as an unknown mode or a negative duration.
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// HVACMode is the mode of a thermostat.
+type HVACMode string
+
+const (
+	HVACModeOff      HVACMode = "off"
+	HVACModeHeat     HVACMode = "heat"
+	HVACModeCool     HVACMode = "cool"
+	HVACModeHeatCool HVACMode = "heatCool"
+)
+
+type setResponse struct {
+	Status    string            `json:"status"`
+	SetStatus map[string]string `json:"setStatus"`
+}
+
+// SetDeviceProperties sets properties of the device with the given ID. No
+// validation is done beyond what Starling does itself; prefer the typed
+// setters where they exist.
+func (c Client) SetDeviceProperties(ctx context.Context, id string, properties map[string]any) error {
+	payload, err := json.Marshal(properties)
+	if err != nil {
+		return err
+	}
+	resp, err := c.makeRequest(ctx, "POST", "/devices/"+url.PathEscape(id), payload)
+	if err != nil {
+		return responseError(resp, err)
+	}
+
+	set := setResponse{}
+	if err := decodeResponse(resp, &set); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(set.SetStatus))
+	for name := range set.SetStatus {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if status := set.SetStatus[name]; status != "OK" {
+			return fmt.Errorf("couldn't set %s: %s", name, status)
+		}
+	}
+	return nil
+}
+
+// checkWritePermission returns ErrWriteNotPermitted if the API key can't
+// write.
+func (c Client) checkWritePermission(ctx context.Context) error {
+	status, err := c.status(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.Permissions.Write {
+		return ErrWriteNotPermitted
+	}
+	return nil
+}
+
+// setThermostat checks that the API key can write and that the thermostat
+// passes check, then sets properties.
+func (c Client) setThermostat(ctx context.Context, id string, check func(ThermostatProperties) error, properties map[string]any) error {
+	if err := c.checkWritePermission(ctx); err != nil {
+		return err
+	}
+	if check != nil {
+		thermostat, err := DeviceProperties[ThermostatProperties](ctx, c, id)
+		if err != nil {
+			return err
+		}
+		if err := check(*thermostat); err != nil {
+			return err
+		}
+	}
+	return c.SetDeviceProperties(ctx, id, properties)
+}
+
+func canHeat(t ThermostatProperties) error {
+	if !t.CanHeat {
+		return fmt.Errorf("%w: thermostat can't heat", ErrNotSupported)
+	}
+	return nil
+}
+
+func canCool(t ThermostatProperties) error {
+	if !t.CanCool {
+		return fmt.Errorf("%w: thermostat can't cool", ErrNotSupported)
+	}
+	return nil
+}
+
+// SetTargetTemperature sets the target temperature of the thermostat, in
+// celsius.
+func (c Client) SetTargetTemperature(ctx context.Context, id string, celsius float64) error {
+	return c.setThermostat(ctx, id, func(t ThermostatProperties) error {
+		if !t.CanHeat && !t.CanCool {
+			return fmt.Errorf("%w: thermostat can neither heat nor cool", ErrNotSupported)
+		}
+		return nil
+	}, map[string]any{"targetTemperature": celsius})
+}
+
+// SetHeatingThreshold sets the temperature, in celsius, below which the
+// thermostat heats when in heatCool mode.
+func (c Client) SetHeatingThreshold(ctx context.Context, id string, celsius float64) error {
+	return c.setThermostat(ctx, id, canHeat, map[string]any{"targetHeatingThresholdTemperature": celsius})
+}
+
+// SetCoolingThreshold sets the temperature, in celsius, above which the
+// thermostat cools when in heatCool mode.
+func (c Client) SetCoolingThreshold(ctx context.Context, id string, celsius float64) error {
+	return c.setThermostat(ctx, id, canCool, map[string]any{"targetCoolingThresholdTemperature": celsius})
+}
+
+// SetHVACMode sets the mode of the thermostat.
+func (c Client) SetHVACMode(ctx context.Context, id string, mode HVACMode) error {
+	var check func(ThermostatProperties) error
+	switch mode {
+	case HVACModeOff:
+	case HVACModeHeat:
+		check = canHeat
+	case HVACModeCool:
+		check = canCool
+	case HVACModeHeatCool:
+		check = func(t ThermostatProperties) error {
+			if err := canHeat(t); err != nil {
+				return err
+			}
+			return canCool(t)
+		}
+	default:
+		return fmt.Errorf("%w: unknown HVAC mode %q", ErrInvalidValue, mode)
+	}
+	return c.setThermostat(ctx, id, check, map[string]any{"hvacMode": mode})
+}
+
+// SetEcoMode turns eco mode on or off.
+func (c Client) SetEcoMode(ctx context.Context, id string, enabled bool) error {
+	return c.setThermostat(ctx, id, nil, map[string]any{"ecoMode": enabled})
+}
+
+// SetFanTimer runs the fan for the given duration. A duration of 0 stops the
+// fan timer.
+func (c Client) SetFanTimer(ctx context.Context, id string, duration time.Duration) error {
+	if duration < 0 {
+		return fmt.Errorf("%w: negative fan timer duration %s", ErrInvalidValue, duration)
+	}
+	properties := map[string]any{"fanTimerActive": duration > 0}
+	if duration > 0 {
+		properties["fanTimerDuration"] = duration.Seconds()
+	}
+	return c.setThermostat(ctx, id, nil, properties)
+}
+
+// SetTargetHumidity sets the target relative humidity of the thermostat, as a
+// percentage.
+func (c Client) SetTargetHumidity(ctx context.Context, id string, percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("%w: humidity %v%% is out of range", ErrInvalidValue, percent)
+	}
+	return c.setThermostat(ctx, id, nil, map[string]any{"targetHumidity": percent})
+}
+
+// confirmInterval is how often the confirming setters poll the device while
+// waiting for it to reach the target state.
+const confirmInterval = time.Second
+
+// LockState is the state of a Nest x Yale lock.
+type LockState string
+
+const (
+	LockStateLocked   LockState = "locked"
+	LockStateUnlocked LockState = "unlocked"
+)
+
+// GuardState is the arm state of a Nest Guard.
+type GuardState string
+
+const (
+	GuardStateOff  GuardState = "off"
+	GuardStateHome GuardState = "home"
+	GuardStateAway GuardState = "away"
+)
+
+// HomeState is the home/away state of a structure.
+type HomeState string
+
+const (
+	HomeStateHome HomeState = "home"
+	HomeStateAway HomeState = "away"
+)
+
+// SetResult is the outcome of a setter which waits for the device to confirm
+// the change.
+type SetResult struct {
+	// Confirmed is true if the device reached the target state before the
+	// timeout.
+	Confirmed bool
+	// State is the last state reported by the device.
+	State string
+	// Elapsed is how long was spent waiting for the device.
+	Elapsed time.Duration
+}
+
+// setAndConfirm sets property to target and then polls the device until
+// current reports the target state or timeout elapses. Not reaching the target
+// state is not an error; the returned SetResult says whether it was confirmed.
+func setAndConfirm[T any](ctx context.Context, c Client, id, property, target string, timeout time.Duration, current func(T) string) (SetResult, error) {
+	if err := c.checkWritePermission(ctx); err != nil {
+		return SetResult{}, err
+	}
+	if err := c.SetDeviceProperties(ctx, id, map[string]any{property: target}); err != nil {
+		return SetResult{}, err
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(confirmInterval)
+	defer ticker.Stop()
+
+	result := SetResult{}
+	for {
+		device, err := DeviceProperties[T](ctx, c, id)
+		if err != nil {
+			return result, err
+		}
+		result.State = current(*device)
+		result.Elapsed = time.Since(start)
+		if result.State == target {
+			result.Confirmed = true
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-deadline.C:
+			return result, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetLockState locks or unlocks the lock, waiting up to timeout for it to
+// report the new state.
+func (c Client) SetLockState(ctx context.Context, id string, state LockState, timeout time.Duration) (SetResult, error) {
+	switch state {
+	case LockStateLocked, LockStateUnlocked:
+	default:
+		return SetResult{}, fmt.Errorf("%w: unknown lock state %q", ErrInvalidValue, state)
+	}
+	return setAndConfirm(ctx, c, id, "targetState", string(state), timeout, func(l YaleLockProperties) string {
+		return l.CurrentState
+	})
+}
+
+// SetGuardState arms or disarms the Guard, waiting up to timeout for it to
+// report the new state.
+func (c Client) SetGuardState(ctx context.Context, id string, state GuardState, timeout time.Duration) (SetResult, error) {
+	switch state {
+	case GuardStateOff, GuardStateHome, GuardStateAway:
+	default:
+		return SetResult{}, fmt.Errorf("%w: unknown Guard state %q", ErrInvalidValue, state)
+	}
+	return setAndConfirm(ctx, c, id, "targetState", string(state), timeout, func(g GuardProperties) string {
+		return g.CurrentState
+	})
+}
+
+// SetHomeState sets the structure to home or away, waiting up to timeout for
+// the change to be reported.
+func (c Client) SetHomeState(ctx context.Context, id string, state HomeState, timeout time.Duration) (SetResult, error) {
+	switch state {
+	case HomeStateHome, HomeStateAway:
+	default:
+		return SetResult{}, fmt.Errorf("%w: unknown home state %q", ErrInvalidValue, state)
+	}
+	return setAndConfirm(ctx, c, id, "homeState", string(state), timeout, func(h HomeAwayControlProperties) string {
+		return h.HomeState
+	})
+}
@@ -0,0 +1,276 @@
+package starling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHub is a Home Hub serving the status and devices endpoints of the
+// Starling API.
+type fakeHub struct {
+	mu      sync.Mutex
+	write   bool
+	devices map[string]map[string]any
+	// setStatus is returned for the properties listed instead of OK, and
+	// those properties aren't changed.
+	setStatus map[string]string
+	// stuck devices accept a new targetState without ever reaching it.
+	stuck map[string]bool
+	// posts are the request bodies of every POST.
+	posts []map[string]any
+}
+
+func (h *fakeHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reply := func(code int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	if r.URL.Path == "/status" {
+		reply(http.StatusOK, map[string]any{
+			"apiReady":    true,
+			"permissions": map[string]bool{"read": true, "write": h.write},
+		})
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/devices/")
+	device, ok := h.devices[id]
+	if !ok {
+		reply(http.StatusNotFound, Error{Status: "error", Code: "NOT_FOUND", Message: "device not found"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		reply(http.StatusOK, map[string]any{"status": "OK", "properties": device})
+	case "POST":
+		properties := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&properties); err != nil {
+			reply(http.StatusBadRequest, Error{Status: "error", Message: err.Error()})
+			return
+		}
+		h.posts = append(h.posts, properties)
+		set := map[string]string{}
+		for name, value := range properties {
+			if status, ok := h.setStatus[name]; ok {
+				set[name] = status
+				continue
+			}
+			set[name] = "OK"
+			device[name] = value
+			if name == "targetState" && !h.stuck[id] {
+				device["currentState"] = value
+			}
+		}
+		reply(http.StatusOK, map[string]any{"status": "OK", "setStatus": set})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeHub(t *testing.T, h *fakeHub) Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, "key")
+}
+
+func TestSetDeviceProperties(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		setStatus  map[string]string
+		properties map[string]any
+		wantErr    string
+	}{
+		{
+			name:       "ok",
+			id:         "t1",
+			properties: map[string]any{"targetTemperature": 21.0, "ecoMode": false},
+		},
+		{
+			name:       "property rejected",
+			id:         "t1",
+			setStatus:  map[string]string{"targetTemperature": "Value out of range"},
+			properties: map[string]any{"targetTemperature": 45.0, "ecoMode": false},
+			wantErr:    "couldn't set targetTemperature: Value out of range",
+		},
+		{
+			name:       "unknown device",
+			id:         "nope",
+			properties: map[string]any{"ecoMode": false},
+			wantErr:    "device not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &fakeHub{
+				write:     true,
+				devices:   map[string]map[string]any{"t1": {"targetTemperature": 20.0, "ecoMode": true}},
+				setStatus: tt.setStatus,
+			}
+			c := newFakeHub(t, h)
+
+			err := c.SetDeviceProperties(context.Background(), tt.id, tt.properties)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want none", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write bool
+		set   func(Client) error
+		want  error
+	}{
+		{
+			name:  "ok",
+			write: true,
+			set: func(c Client) error {
+				return c.SetHVACMode(context.Background(), "t1", HVACModeHeat)
+			},
+		},
+		{
+			name: "thermostat not writable",
+			set: func(c Client) error {
+				return c.SetEcoMode(context.Background(), "t1", true)
+			},
+			want: ErrWriteNotPermitted,
+		},
+		{
+			name: "lock not writable",
+			set: func(c Client) error {
+				_, err := c.SetLockState(context.Background(), "l1", LockStateUnlocked, time.Second)
+				return err
+			},
+			want: ErrWriteNotPermitted,
+		},
+		{
+			name:  "mode not supported",
+			write: true,
+			set: func(c Client) error {
+				return c.SetHVACMode(context.Background(), "t1", HVACModeCool)
+			},
+			want: ErrNotSupported,
+		},
+		{
+			name:  "threshold not supported",
+			write: true,
+			set: func(c Client) error {
+				return c.SetCoolingThreshold(context.Background(), "t1", 24)
+			},
+			want: ErrNotSupported,
+		},
+		{
+			name:  "unknown mode",
+			write: true,
+			set: func(c Client) error {
+				return c.SetHVACMode(context.Background(), "t1", "auto")
+			},
+			want: ErrInvalidValue,
+		},
+		{
+			name:  "humidity out of range",
+			write: true,
+			set: func(c Client) error {
+				return c.SetTargetHumidity(context.Background(), "t1", 101)
+			},
+			want: ErrInvalidValue,
+		},
+		{
+			name:  "unknown lock state",
+			write: true,
+			set: func(c Client) error {
+				_, err := c.SetLockState(context.Background(), "l1", "open", time.Second)
+				return err
+			},
+			want: ErrInvalidValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &fakeHub{
+				write: tt.write,
+				devices: map[string]map[string]any{
+					"t1": {"canHeat": true, "canCool": false},
+					"l1": {"currentState": "locked", "targetState": "locked"},
+				},
+			}
+			c := newFakeHub(t, h)
+
+			err := tt.set(c)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if tt.want != nil && len(h.posts) > 0 {
+				t.Errorf("device was changed despite the error: %v", h.posts)
+			}
+		})
+	}
+}
+
+func TestSetLockState(t *testing.T) {
+	tests := []struct {
+		name  string
+		stuck bool
+		want  SetResult
+	}{
+		{
+			name: "confirmed",
+			want: SetResult{Confirmed: true, State: "unlocked"},
+		},
+		{
+			name:  "timed out",
+			stuck: true,
+			want:  SetResult{Confirmed: false, State: "locked"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &fakeHub{
+				write:   true,
+				devices: map[string]map[string]any{"l1": {"currentState": "locked", "targetState": "locked"}},
+				stuck:   map[string]bool{"l1": tt.stuck},
+			}
+			c := newFakeHub(t, h)
+
+			// The timeout is shorter than confirmInterval, so a lock which
+			// doesn't change is only polled once.
+			timeout := 100 * time.Millisecond
+			start := time.Now()
+			got, err := c.SetLockState(context.Background(), "l1", LockStateUnlocked, timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Confirmed != tt.want.Confirmed || got.State != tt.want.State {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed >= confirmInterval {
+				t.Errorf("waited %s, want at most the %s timeout", elapsed, timeout)
+			}
+			if len(h.posts) != 1 || h.posts[0]["targetState"] != "unlocked" {
+				t.Errorf("got POSTs %v, want one setting targetState to unlocked", h.posts)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesog/nest_exporter/starling"
+)
+
+// deviceSnapshot is the most recent state of a device seen by the poller.
+type deviceSnapshot struct {
+	starling.CommonProperties
+	// FetchedAt is when Properties were fetched.
+	FetchedAt time.Time `json:"fetchedAt"`
+	// Properties is the device's properties struct from the starling
+	// package, or a map for unsupported device types.
+	Properties any `json:"properties"`
+	// Error is the error from the last attempt to fetch the device, if it
+	// failed. Properties are then those of the last successful attempt.
+	Error string `json:"error,omitempty"`
+}
+
+// hubStatus is the most recent status of the Starling API seen by the poller.
+type hubStatus struct {
+	*starling.Status
+	// Up is true if the status was fetched and the API is ready.
+	Up        bool      `json:"up"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// pollError is an error seen by the poller.
+type pollError struct {
+	At time.Time `json:"at"`
+	// Device is the ID of the device the error is about, if any.
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error"`
+}
+
+// maxRecentErrors is how many of the most recent errors the store keeps.
+const maxRecentErrors = 20
+
+// deviceStore holds the latest status of the hub and snapshot of each device.
+type deviceStore struct {
+	mu      sync.RWMutex
+	status  hubStatus
+	devices map[string]deviceSnapshot
+	errors  []pollError
+}
+
+func newDeviceStore() *deviceStore {
+	return &deviceStore{devices: make(map[string]deviceSnapshot)}
+}
+
+// setStatus records the result of fetching the hub's status.
+func (s *deviceStore) setStatus(status *starling.Status, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status = hubStatus{
+		Status:    status,
+		Up:        err == nil && status != nil && status.APIReady,
+		FetchedAt: at,
+	}
+	if err != nil {
+		s.status.Error = err.Error()
+		s.addError("", err, at)
+	}
+}
+
+// recordError records an error which isn't about the hub's status or a
+// single device, such as failing to list the devices.
+func (s *deviceStore) recordError(err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addError("", err, at)
+}
+
+// addError adds to the recent errors, dropping the oldest once there are
+// maxRecentErrors. s.mu must be held.
+func (s *deviceStore) addError(device string, err error, at time.Time) {
+	s.errors = append(s.errors, pollError{At: at, Device: device, Error: err.Error()})
+	if len(s.errors) > maxRecentErrors {
+		s.errors = s.errors[len(s.errors)-maxRecentErrors:]
+	}
+}
+
+// recentErrors returns the most recent errors, newest first.
+func (s *deviceStore) recentErrors() []pollError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	errs := make([]pollError, len(s.errors))
+	for i, e := range s.errors {
+		errs[len(errs)-1-i] = e
+	}
+	return errs
+}
+
+func (s *deviceStore) hubStatus() hubStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// update records newly fetched properties for the device and returns the
+// previous snapshot, if there was one.
+func (s *deviceStore) update(device starling.CommonProperties, properties any, at time.Time) (deviceSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.devices[device.ID]
+	s.devices[device.ID] = deviceSnapshot{
+		CommonProperties: device,
+		FetchedAt:        at,
+		Properties:       properties,
+	}
+	return prev, ok
+}
+
+// setError records that fetching the device failed, keeping its last
+// properties.
+func (s *deviceStore) setError(device starling.CommonProperties, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.devices[device.ID]
+	snap.CommonProperties = device
+	snap.Error = err.Error()
+	s.devices[device.ID] = snap
+	s.addError(device.ID, err, time.Now())
+}
+
+// retain removes every device whose ID isn't in ids.
+func (s *deviceStore) retain(ids map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.devices {
+		if !ids[id] {
+			delete(s.devices, id)
+		}
+	}
+}
+
+func (s *deviceStore) get(id string) (deviceSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap, ok := s.devices[id]
+	return snap, ok
+}
+
+// list returns every device, ordered by ID.
+func (s *deviceStore) list() []deviceSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	devices := make([]deviceSnapshot, 0, len(s.devices))
+	for _, snap := range s.devices {
+		devices = append(devices, snap)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
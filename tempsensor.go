@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tempSensorLabels = []string{"id", "name", "where"}
+
+	tempSensorCurrentTemperature = newTemperatureDesc(
+		subsystemTempSensor,
+		"current_temperature",
+		"Current temperature",
+		tempSensorLabels,
+	)
+
+	// Metrics not directly exposed by Starling, but we compute them.
+	tempSensorBatteryLow = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemTempSensor, "battery_low"),
+		"Battery is low",
+		tempSensorLabels,
+		nil,
+	)
+)
+
+func init() {
+	registerDeviceType("temp_sensor", typedDevice[starling.TemperatureSensorProperties](func(c Collector, sensor starling.TemperatureSensorProperties, ch chan<- prometheus.Metric) {
+		tempSensorMetrics(sensor, c.fahrenheit, ch)
+	}))
+}
+
+func tempSensorMetrics(sensor starling.TemperatureSensorProperties, fahrenheit bool, ch chan<- prometheus.Metric) {
+	tempSensorCurrentTemperature.metrics(
+		sensor.CurrentTemperature,
+		fahrenheit,
+		ch,
+		sensor.ID, sensor.Name, sensor.Where,
+	)
+
+	// Computed metrics
+	ch <- prometheus.MustNewConstMetric(
+		tempSensorBatteryLow,
+		prometheus.GaugeValue,
+		boolToFloat64(sensor.BatteryStatus == "low"),
+		sensor.ID, sensor.Name, sensor.Where,
+	)
+}
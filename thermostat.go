@@ -8,17 +8,17 @@ import (
 var (
 	thermostatLabels = []string{"id", "name", "where"}
 
-	thermostatCurrentTemperature = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, subsystemThermostat, "current_temperature_celsius"),
-		"Current temperature in celsius",
+	thermostatCurrentTemperature = newTemperatureDesc(
+		subsystemThermostat,
+		"current_temperature",
+		"Current temperature",
 		thermostatLabels,
-		nil,
 	)
-	thermostatTargetTemperature = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, subsystemThermostat, "target_temperature_celsius"),
-		"Target temperature in celsius",
+	thermostatTargetTemperature = newTemperatureDesc(
+		subsystemThermostat,
+		"target_temperature",
+		"Target temperature",
 		thermostatLabels,
-		nil,
 	)
 	thermostatEcoMode = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, subsystemThermostat, "eco_mode"),
@@ -26,6 +26,12 @@ var (
 		thermostatLabels,
 		nil,
 	)
+	thermostatDisplayUnit = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemThermostat, "display_unit_info"),
+		"Temperature unit shown on the thermostat",
+		append(thermostatLabels, "unit"),
+		nil,
+	)
 	thermostatHumidityPct = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, subsystemThermostat, "humidity_percent"),
 		"Relative humidity at the thermostat",
@@ -52,21 +58,52 @@ var (
 		thermostatLabels,
 		nil,
 	)
+	thermostatHeatingSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemThermostat, "heating_seconds_total"),
+		"Total time spent heating, in seconds",
+		thermostatLabels,
+		nil,
+	)
+	thermostatCoolingSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemThermostat, "cooling_seconds_total"),
+		"Total time spent cooling, in seconds",
+		thermostatLabels,
+		nil,
+	)
+	thermostatFanSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemThermostat, "fan_seconds_total"),
+		"Total time the fan has been running, in seconds",
+		thermostatLabels,
+		nil,
+	)
 )
 
-func thermostatMetrics(thermostat starling.ThermostatProperties, ch chan<- prometheus.Metric) {
-	ch <- prometheus.MustNewConstMetric(
-		thermostatCurrentTemperature,
-		prometheus.GaugeValue,
+func init() {
+	registerDeviceType("thermostat", typedDevice[starling.ThermostatProperties](func(c Collector, thermostat starling.ThermostatProperties, ch chan<- prometheus.Metric) {
+		runtime := c.hvacRuntime.get(thermostat.ID)
+		thermostatMetrics(thermostat, runtime, c.fahrenheit, ch)
+	}))
+}
+
+func thermostatMetrics(thermostat starling.ThermostatProperties, runtime hvacDeviceRuntime, fahrenheit bool, ch chan<- prometheus.Metric) {
+	thermostatCurrentTemperature.metrics(
 		thermostat.CurrentTemperature,
+		fahrenheit,
+		ch,
 		thermostat.ID, thermostat.Name, thermostat.Where,
 	)
-	ch <- prometheus.MustNewConstMetric(
-		thermostatTargetTemperature,
-		prometheus.GaugeValue,
+	thermostatTargetTemperature.metrics(
 		thermostat.TargetTemperature,
+		fahrenheit,
+		ch,
 		thermostat.ID, thermostat.Name, thermostat.Where,
 	)
+	ch <- prometheus.MustNewConstMetric(
+		thermostatDisplayUnit,
+		prometheus.GaugeValue,
+		1,
+		thermostat.ID, thermostat.Name, thermostat.Where, thermostat.DisplayTemperatureUnits,
+	)
 	ch <- prometheus.MustNewConstMetric(
 		thermostatEcoMode,
 		prometheus.GaugeValue,
@@ -99,4 +136,24 @@ func thermostatMetrics(thermostat starling.ThermostatProperties, ch chan<- prome
 		boolToFloat64(thermostat.HVACMode == "cool" && thermostat.HVACState == "cooling"),
 		thermostat.ID, thermostat.Name, thermostat.Where,
 	)
+
+	// Runtime counters, accumulated between polls
+	ch <- prometheus.MustNewConstMetric(
+		thermostatHeatingSeconds,
+		prometheus.CounterValue,
+		runtime.HeatingSeconds,
+		thermostat.ID, thermostat.Name, thermostat.Where,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		thermostatCoolingSeconds,
+		prometheus.CounterValue,
+		runtime.CoolingSeconds,
+		thermostat.ID, thermostat.Name, thermostat.Where,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		thermostatFanSeconds,
+		prometheus.CounterValue,
+		runtime.FanSeconds,
+		thermostat.ID, thermostat.Name, thermostat.Where,
+	)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// landingPageTemplate shows the status of the hub and devices from the last
+// poll.
+var landingPageTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Nest Exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.7em; text-align: left; }
+.ok { color: #080; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Nest Exporter</h1>
+<p>
+{{- if .Metrics }}<a href="/metrics">Metrics</a> · {{ end -}}
+<a href="/api/v1/devices">Devices API</a>
+</p>
+
+<h2>Hubs</h2>
+<table>
+<tr><th>Hub</th><th>Status</th><th>App</th><th>API version</th><th>Connected to Nest</th><th>Permissions</th><th>Last poll</th></tr>
+{{- with .Status }}
+<tr>
+<td>{{ $.Hub }}</td>
+{{- if .Up }}<td class="ok">up</td>{{ else }}<td class="error">down{{ with .Error }}: {{ . }}{{ end }}</td>{{ end }}
+{{- with .Status }}
+<td>{{ .AppName }}</td>
+<td>{{ .APIVersion }}</td>
+<td>{{ if .ConnectedToNest }}yes{{ else }}<span class="error">no</span>{{ end }}</td>
+<td>{{ if .Permissions.Read }}read {{ end }}{{ if .Permissions.Write }}write {{ end }}{{ if .Permissions.Camera }}camera{{ end }}</td>
+{{- else }}
+<td></td><td></td><td></td><td></td>
+{{- end }}
+<td title="{{ rfc3339 .FetchedAt }}">{{ ago .FetchedAt }}</td>
+</tr>
+{{- end }}
+</table>
+
+<h2>Devices</h2>
+{{- if .Devices }}
+<table>
+<tr><th>Name</th><th>Where</th><th>Structure</th><th>Type</th><th>ID</th><th>Last poll</th><th>Error</th></tr>
+{{- range .Devices }}
+<tr>
+<td><a href="/api/v1/devices/{{ .ID }}">{{ .Name }}</a></td>
+<td>{{ .Where }}</td>
+<td>{{ .StructureName }}</td>
+<td>{{ .Type }}</td>
+<td>{{ .ID }}</td>
+<td title="{{ rfc3339 .FetchedAt }}">{{ ago .FetchedAt }}</td>
+<td class="error">{{ .Error }}</td>
+</tr>
+{{- end }}
+</table>
+{{- else }}
+<p>No devices found yet.</p>
+{{- end }}
+
+<h2>Recent errors</h2>
+{{- if .Errors }}
+<table>
+<tr><th>Time</th><th>Device</th><th>Error</th></tr>
+{{- range .Errors }}
+<tr><td title="{{ rfc3339 .At }}">{{ ago .At }}</td><td>{{ .Device }}</td><td class="error">{{ .Error }}</td></tr>
+{{- end }}
+</table>
+{{- else }}
+<p>None.</p>
+{{- end }}
+</body>
+</html>
+`))
+
+// landingPage serves an HTML overview of the hub and devices at /.
+type landingPage struct {
+	store *deviceStore
+	// hub identifies the Home Hub, e.g. the host of its API.
+	hub string
+	// metrics is whether /metrics is served, to link to it.
+	metrics bool
+}
+
+func (l landingPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := struct {
+		Hub     string
+		Status  hubStatus
+		Devices []deviceSnapshot
+		Errors  []pollError
+		Metrics bool
+	}{
+		Hub:     l.hub,
+		Status:  l.store.hubStatus(),
+		Devices: l.store.list(),
+		Errors:  l.store.recentErrors(),
+		Metrics: l.metrics,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingPageTemplate.Execute(w, data); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("error rendering landing page")
+	}
+}
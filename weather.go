@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/jamesog/nest_exporter/starling"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	weatherLabels = []string{"id", "name", "structure"}
+
+	weatherCurrentTemperature = newTemperatureDesc(
+		subsystemWeather,
+		"current_temperature",
+		"Current outside temperature",
+		weatherLabels,
+	)
+	weatherHumidityPct = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystemWeather, "humidity_percent"),
+		"Current outside relative humidity",
+		weatherLabels,
+		nil,
+	)
+)
+
+func init() {
+	registerDeviceType("weather", typedDevice[starling.WeatherServiceProperties](func(c Collector, weather starling.WeatherServiceProperties, ch chan<- prometheus.Metric) {
+		weatherMetrics(weather, c.fahrenheit, ch)
+	}))
+}
+
+func weatherMetrics(weather starling.WeatherServiceProperties, fahrenheit bool, ch chan<- prometheus.Metric) {
+	weatherCurrentTemperature.metrics(
+		weather.CurrentTemperature,
+		fahrenheit,
+		ch,
+		weather.ID, weather.Name, weather.StructureName,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		weatherHumidityPct,
+		prometheus.GaugeValue,
+		weather.HumidityPercent,
+		weather.ID, weather.Name, weather.StructureName,
+	)
+}
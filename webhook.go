@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultWebhookTemplate sends the change as JSON.
+const defaultWebhookTemplate = `{{ json . }}`
+
+var (
+	// safetyProperties are the properties which trigger webhooks, by device
+	// type.
+	safetyProperties = map[string][]string{
+		"protect": {"smokeDetected", "coDetected", "smokeStateDetail", "coStateDetail"},
+	}
+	// securityProperties also trigger webhooks if security events are
+	// enabled.
+	securityProperties = map[string][]string{
+		"lock":   {"isTampered"},
+		"detect": {"isTampered"},
+		"guard":  {"currentState"},
+	}
+
+	webhookFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "webhook",
+			Name:      "delivery_failures_total",
+			Help:      "Number of webhooks which couldn't be delivered after all retries",
+		},
+		[]string{"host"},
+	)
+)
+
+// webhookNotifier posts safety-related property changes to webhooks as soon
+// as the poller sees them.
+type webhookNotifier struct {
+	urls       []string
+	template   *template.Template
+	retries    int
+	client     *http.Client
+	properties map[string]map[string]bool
+
+	mu sync.Mutex
+	// seen are the devices which have been polled, for initial.
+	seen map[string]bool
+}
+
+// newWebhookNotifier returns a notifier which posts to urls. The payload is
+// rendered from the text/template in templateFile, or is the change as JSON if
+// templateFile is empty. If security is true, lock and Detect tampering and
+// Guard state changes are sent as well as Protect alarms.
+func newWebhookNotifier(urls []string, templateFile string, security bool, retries int) (*webhookNotifier, error) {
+	for _, u := range urls {
+		parsed, err := url.ParseRequestURI(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook URL: %w", err)
+		}
+		// Initialise the counter so that it's exported before any failures.
+		webhookFailures.WithLabelValues(parsed.Host)
+	}
+
+	text := defaultWebhookTemplate
+	if templateFile != "" {
+		b, err := os.ReadFile(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &webhookNotifier{
+		urls:       urls,
+		template:   tmpl,
+		retries:    retries,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		properties: make(map[string]map[string]bool),
+		seen:       make(map[string]bool),
+	}
+	n.watch(safetyProperties)
+	if security {
+		n.watch(securityProperties)
+	}
+	return n, nil
+}
+
+func (n *webhookNotifier) watch(properties map[string][]string) {
+	for deviceType, names := range properties {
+		if n.properties[deviceType] == nil {
+			n.properties[deviceType] = make(map[string]bool)
+		}
+		for _, name := range names {
+			n.properties[deviceType][name] = true
+		}
+	}
+}
+
+// run sends webhooks for changes published to the broker until ctx is
+// cancelled. Safety events mustn't be lost, so the subscription is reliable;
+// delivery happens in the background so that the poller isn't held up.
+func (n *webhookNotifier) run(ctx context.Context, changes *changeBroker) {
+	ch := changes.subscribeReliable(256)
+	defer changes.unsubscribe(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-ch:
+			n.notify(ctx, change)
+		}
+	}
+}
+
+// initial sends webhooks for devices which are already alarming when they're
+// first polled, as there's no earlier poll to see the change from. It's
+// called by the poller after each poll.
+func (n *webhookNotifier) initial(_ hubStatus, devices []deviceSnapshot) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Forget removed devices, as they're new to the poller if they come
+	// back.
+	present := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		present[device.ID] = true
+	}
+	for id := range n.seen {
+		if !present[id] {
+			delete(n.seen, id)
+		}
+	}
+
+	for _, device := range devices {
+		if device.Properties == nil || n.seen[device.ID] || n.properties[device.Type] == nil {
+			continue
+		}
+		n.seen[device.ID] = true
+		properties, err := propertiesMap(device.Properties)
+		if err != nil {
+			log.Err(err).Str("id", device.ID).Msg("error converting device properties")
+			continue
+		}
+		names := make([]string, 0, len(n.properties[device.Type]))
+		for name := range n.properties[device.Type] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !alarming(properties[name]) {
+				continue
+			}
+			n.notify(context.Background(), propertyChange{
+				ID:       device.ID,
+				Type:     device.Type,
+				Name:     device.Name,
+				Where:    device.Where,
+				Property: name,
+				New:      properties[name],
+				At:       device.FetchedAt,
+			})
+		}
+	}
+}
+
+// alarming reports whether a property value is an alarm: true, or a Protect
+// state detail of warn or emergency.
+func alarming(value any) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case string:
+		pct, ok := convertStateDetail(value)
+		return ok && pct > 0
+	}
+	return false
+}
+
+// notify posts the change to every webhook if it's to a watched property.
+func (n *webhookNotifier) notify(ctx context.Context, change propertyChange) {
+	if !n.properties[change.Type][change.Property] {
+		return
+	}
+	var payload bytes.Buffer
+	if err := n.template.Execute(&payload, change); err != nil {
+		log.Err(err).Msg("error rendering webhook template")
+		return
+	}
+	for _, u := range n.urls {
+		go n.deliver(ctx, u, payload.Bytes())
+	}
+}
+
+// deliver posts payload to u, retrying with exponential backoff.
+func (n *webhookNotifier) deliver(ctx context.Context, u string, payload []byte) {
+	host := u
+	if parsed, err := url.Parse(u); err == nil {
+		host = parsed.Host
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := n.post(ctx, u, payload)
+		if err == nil {
+			return
+		}
+		if attempt >= n.retries {
+			log.Err(err).Str("host", host).Msg("giving up delivering webhook")
+			webhookFailures.WithLabelValues(host).Inc()
+			return
+		}
+		log.Warn().Err(err).Str("host", host).Dur("retry_in", backoff).Msg("error delivering webhook")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(ctx context.Context, u string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}